@@ -0,0 +1,71 @@
+// Package bencode encodes and decodes the serialization format BitTorrent uses
+// for torrent files, tracker responses, DHT messages and extension messages.
+//
+// Values map onto Go types much like encoding/json: integers onto int and uint
+// kinds, strings onto string, []byte and byte arrays of the same length, lists
+// onto slices and dictionaries onto maps with string keys or structs. Struct
+// fields are matched by their bencode tag, `bencode:"name,omitempty"`, or by
+// their name. Decoding into an empty interface gives int64, string,
+// []interface{} and map[string]interface{}. RawMessage keeps a value's bytes as
+// they were, which is how the infohash of a torrent is taken
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// DefaultMaxDepth is how deeply lists and dictionaries may nest by default
+const DefaultMaxDepth = 64
+
+// DefaultMaxSize is the largest value a Decoder reads by default
+const DefaultMaxSize = 64 * 1024 * 1024
+
+// RawMessage is a raw encoded value. Decoding into it copies the value's bytes
+// without interpreting them, encoding it writes them out unchanged
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage{})
+
+// SyntaxError describes malformed or, in strict mode, non-canonical input
+type SyntaxError struct {
+	msg string
+	//where in the input the problem was found
+	Offset int64
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+// UnmarshalTypeError is returned when a value doesn't fit the Go type it is decoded into
+type UnmarshalTypeError struct {
+	Value  string //"integer", "string", "list" or "dictionary"
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot decode %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// InvalidUnmarshalError is returned when Unmarshal isn't given a non-nil pointer
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "bencode: Unmarshal(nil)"
+	}
+	return fmt.Sprintf("bencode: Unmarshal(non-pointer %s)", e.Type)
+}
+
+// UnsupportedTypeError is returned when a value can't be encoded
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("bencode: unsupported type %s", e.Type)
+}
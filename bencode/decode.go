@@ -0,0 +1,469 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+)
+
+// Unmarshal decodes the single bencoded value in data into the value v points to.
+// Dictionary keys without a matching struct field are skipped. Use a Decoder to
+// limit nesting or to reject input that isn't in canonical form
+func Unmarshal(data []byte, v interface{}) error {
+	d := decodeState{data: data, maxDepth: DefaultMaxDepth}
+	return d.unmarshal(v)
+}
+
+// CheckCanonical returns an error unless data is exactly one value in canonical
+// form: dictionary keys sorted and unique, and no leading zeros or negative zero
+func CheckCanonical(data []byte) error {
+	d := decodeState{data: data, maxDepth: DefaultMaxDepth, strict: true}
+	err := d.skip()
+	if err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return d.syntaxError("trailing data after value")
+	}
+	return nil
+}
+
+type decodeState struct {
+	data []byte
+	off  int
+
+	//offset of data in the stream, so errors point at the right place
+	base int64
+
+	depth    int
+	maxDepth int
+	strict   bool
+}
+
+func (d *decodeState) unmarshal(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	err := d.value(rv.Elem())
+	if err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return d.syntaxError("trailing data after value")
+	}
+	return nil
+}
+
+func (d *decodeState) syntaxError(msg string) error {
+	return &SyntaxError{msg: msg, Offset: d.base + int64(d.off)}
+}
+
+func (d *decodeState) typeError(value string, t reflect.Type) error {
+	return &UnmarshalTypeError{Value: value, Type: t, Offset: d.base + int64(d.off)}
+}
+
+func (d *decodeState) peek() (byte, error) {
+	if d.off >= len(d.data) {
+		return 0, d.syntaxError("unexpected end of input")
+	}
+	return d.data[d.off], nil
+}
+
+func (d *decodeState) enter() error {
+	d.depth++
+	if d.maxDepth > 0 && d.depth > d.maxDepth {
+		return d.syntaxError("exceeded max depth of " + strconv.Itoa(d.maxDepth))
+	}
+	return nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// readInt reads i<number>e
+func (d *decodeState) readInt() (int64, error) {
+	d.off++ // 'i'
+	end := bytes.IndexByte(d.data[d.off:], 'e')
+	if end < 0 {
+		return 0, d.syntaxError("unterminated integer")
+	}
+	s := d.data[d.off : d.off+end]
+
+	digits := s
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return 0, d.syntaxError("empty integer")
+	}
+	for _, c := range digits {
+		if !isDigit(c) {
+			return 0, d.syntaxError("invalid integer " + strconv.Quote(string(s)))
+		}
+	}
+	if d.strict && digits[0] == '0' && (len(digits) > 1 || len(digits) != len(s)) {
+		return 0, d.syntaxError("non-canonical integer " + strconv.Quote(string(s)))
+	}
+
+	n, err := strconv.ParseInt(string(s), 10, 64)
+	if err != nil {
+		return 0, d.syntaxError("integer " + strconv.Quote(string(s)) + " out of range")
+	}
+	d.off += end + 1
+	return n, nil
+}
+
+// readString reads <length>:<bytes>. The result points into data
+func (d *decodeState) readString() ([]byte, error) {
+	colon := bytes.IndexByte(d.data[d.off:], ':')
+	if colon <= 0 {
+		return nil, d.syntaxError("invalid string length")
+	}
+	lengthStr := d.data[d.off : d.off+colon]
+	for _, c := range lengthStr {
+		if !isDigit(c) {
+			return nil, d.syntaxError("invalid string length")
+		}
+	}
+	if d.strict && lengthStr[0] == '0' && len(lengthStr) > 1 {
+		return nil, d.syntaxError("non-canonical string length")
+	}
+
+	length, err := strconv.Atoi(string(lengthStr))
+	start := d.off + colon + 1
+	if err != nil || length > len(d.data)-start {
+		return nil, d.syntaxError("string runs past the end of input")
+	}
+	d.off = start + length
+	return d.data[start:d.off], nil
+}
+
+// readKey reads a dictionary key. In strict mode keys must come in sorted order
+func (d *decodeState) readKey(prev []byte) ([]byte, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	if !isDigit(c) {
+		return nil, d.syntaxError("dictionary key is not a string")
+	}
+
+	start := d.off
+	key, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	if d.strict && prev != nil && bytes.Compare(prev, key) >= 0 {
+		d.off = start
+		return nil, d.syntaxError("dictionary key " + strconv.Quote(string(key)) + " out of order")
+	}
+	return key, nil
+}
+
+// skip checks the next value and moves past it
+func (d *decodeState) skip() error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		_, err = d.readInt()
+		return err
+	case isDigit(c):
+		_, err = d.readString()
+		return err
+	case c == 'l':
+		return d.eachElem(d.skip)
+	case c == 'd':
+		return d.eachEntry(func([]byte) error { return d.skip() })
+	default:
+		return d.syntaxError("unexpected byte " + strconv.QuoteRune(rune(c)))
+	}
+}
+
+// eachElem calls fn for every element of the list at the current offset, with
+// the offset at the element
+func (d *decodeState) eachElem(fn func() error) error {
+	d.off++ // 'l'
+	err := d.enter()
+	if err != nil {
+		return err
+	}
+
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			break
+		}
+		err = fn()
+		if err != nil {
+			return err
+		}
+	}
+
+	d.off++ // 'e'
+	d.depth--
+	return nil
+}
+
+// eachEntry calls fn with every key of the dictionary at the current offset,
+// with the offset at the key's value
+func (d *decodeState) eachEntry(fn func(key []byte) error) error {
+	d.off++ // 'd'
+	err := d.enter()
+	if err != nil {
+		return err
+	}
+
+	var prev []byte
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			break
+		}
+
+		key, err := d.readKey(prev)
+		if err != nil {
+			return err
+		}
+		prev = key
+		err = fn(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.off++ // 'e'
+	d.depth--
+	return nil
+}
+
+// value decodes the next value into v
+func (d *decodeState) value(v reflect.Value) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+
+	if v.Type() == rawMessageType {
+		start := d.off
+		err := d.skip()
+		if err != nil {
+			return err
+		}
+		v.SetBytes(append(RawMessage(nil), d.data[start:d.off]...))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return d.typeError(valueName(c), v.Type())
+		}
+		x, err := d.generic()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(x))
+		return nil
+	}
+
+	switch {
+	case c == 'i':
+		return d.integer(v)
+	case isDigit(c):
+		return d.str(v)
+	case c == 'l':
+		return d.list(v)
+	case c == 'd':
+		return d.dict(v)
+	default:
+		return d.syntaxError("unexpected byte " + strconv.QuoteRune(rune(c)))
+	}
+}
+
+func valueName(c byte) string {
+	switch {
+	case c == 'i':
+		return "integer"
+	case c == 'l':
+		return "list"
+	case c == 'd':
+		return "dictionary"
+	default:
+		return "string"
+	}
+}
+
+func (d *decodeState) integer(v reflect.Value) error {
+	start := d.off
+	n, err := d.readInt()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(n) {
+			d.off = start
+			return d.typeError("integer "+strconv.FormatInt(n, 10), v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			d.off = start
+			return d.typeError("integer "+strconv.FormatInt(n, 10), v.Type())
+		}
+		v.SetUint(uint64(n))
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	default:
+		d.off = start
+		return d.typeError("integer", v.Type())
+	}
+	return nil
+}
+
+func (d *decodeState) str(v reflect.Value) error {
+	start := d.off
+	s, err := d.readString()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(append([]byte{}, s...))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == len(s):
+		reflect.Copy(v, reflect.ValueOf(s))
+	default:
+		d.off = start
+		return d.typeError("string", v.Type())
+	}
+	return nil
+}
+
+func (d *decodeState) list(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		n := 0
+		err := d.eachElem(func() error {
+			if n >= v.Len() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			n++
+			return d.value(v.Index(n - 1))
+		})
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		}
+		v.SetLen(n)
+		return nil
+	case reflect.Array:
+		n := 0
+		err := d.eachElem(func() error {
+			if n >= v.Len() {
+				return d.typeError("list longer than "+strconv.Itoa(v.Len()), v.Type())
+			}
+			n++
+			return d.value(v.Index(n - 1))
+		})
+		if err != nil {
+			return err
+		}
+		for ; n < v.Len(); n++ {
+			v.Index(n).SetZero()
+		}
+		return nil
+	default:
+		return d.typeError("list", v.Type())
+	}
+}
+
+func (d *decodeState) dict(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Map:
+		t := v.Type()
+		if t.Key().Kind() != reflect.String {
+			return d.typeError("dictionary", t)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(t))
+		}
+		return d.eachEntry(func(key []byte) error {
+			elem := reflect.New(t.Elem()).Elem()
+			err := d.value(elem)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(t.Key()), elem)
+			return nil
+		})
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		return d.eachEntry(func(key []byte) error {
+			i, ok := fields.byName[string(key)]
+			if !ok {
+				return d.skip()
+			}
+			return d.value(v.Field(fields.list[i].index))
+		})
+	default:
+		return d.typeError("dictionary", v.Type())
+	}
+}
+
+// generic decodes the next value into int64, string, []interface{} or map[string]interface{}
+func (d *decodeState) generic() (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == 'i':
+		return d.readInt()
+	case isDigit(c):
+		s, err := d.readString()
+		return string(s), err
+	case c == 'l':
+		list := []interface{}{}
+		err := d.eachElem(func() error {
+			x, err := d.generic()
+			list = append(list, x)
+			return err
+		})
+		return list, err
+	case c == 'd':
+		dict := map[string]interface{}{}
+		err := d.eachEntry(func(key []byte) error {
+			x, err := d.generic()
+			dict[string(key)] = x
+			return err
+		})
+		return dict, err
+	default:
+		return nil, d.syntaxError("unexpected byte " + strconv.QuoteRune(rune(c)))
+	}
+}
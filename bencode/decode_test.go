@@ -0,0 +1,286 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalGeneric(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want interface{}
+	}{
+		{"integer", "i42e", int64(42)},
+		{"negative integer", "i-7e", int64(-7)},
+		{"zero", "i0e", int64(0)},
+		{"string", "4:spam", "spam"},
+		{"empty string", "0:", ""},
+		{"list", "l4:spami42ee", []interface{}{"spam", int64(42)}},
+		{"empty list", "le", []interface{}{}},
+		{"dictionary", "d3:cow3:moo4:spaml1:a1:bee", map[string]interface{}{
+			"cow":  "moo",
+			"spam": []interface{}{"a", "b"},
+		}},
+		{"empty dictionary", "de", map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got interface{}
+			err := Unmarshal([]byte(tt.in), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty input", ""},
+		{"unterminated integer", "i42"},
+		{"empty integer", "ie"},
+		{"minus only", "i-e"},
+		{"letters in integer", "i4x2e"},
+		{"integer out of range", "i99999999999999999999e"},
+		{"string past the end", "5:spam"},
+		{"missing colon", "4spam"},
+		{"unterminated list", "l4:spam"},
+		{"unterminated dictionary", "d3:cow3:moo"},
+		{"integer key", "di1ei2ee"},
+		{"trailing data", "i1ei2e"},
+		{"unknown byte", "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v interface{}
+			err := Unmarshal([]byte(tt.in), &v)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Errorf("got %v, want a SyntaxError", err)
+			}
+		})
+	}
+}
+
+// these decode fine, but only canonical input gives the same bytes back, which infohashes depend on
+func TestStrict(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		canonical bool
+	}{
+		{"sorted keys", "d1:ai1e1:bi2ee", true},
+		{"unsorted keys", "d1:bi2e1:ai1ee", false},
+		{"duplicate keys", "d1:ai1e1:ai2ee", false},
+		{"unsorted keys deeper down", "l d1:bi2e1:ai1ee e", false},
+		{"negative zero", "i-0e", false},
+		{"leading zero", "i03e", false},
+		{"negative leading zero", "i-03e", false},
+		{"zero", "i0e", true},
+		{"negative", "i-3e", true},
+		{"leading zero in string length", "03:abc", false},
+		{"zero string length", "0:", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := []byte(strings.ReplaceAll(tt.in, " ", ""))
+
+			var lenient interface{}
+			err := Unmarshal(in, &lenient)
+			if err != nil {
+				t.Fatalf("lenient decoding failed: %v", err)
+			}
+
+			err = CheckCanonical(in)
+			if tt.canonical && err != nil {
+				t.Errorf("CheckCanonical rejected canonical input: %v", err)
+			}
+			if !tt.canonical && err == nil {
+				t.Error("CheckCanonical accepted non-canonical input")
+			}
+
+			dec := NewDecoder(bytes.NewReader(in))
+			dec.Strict = true
+			var strict interface{}
+			err = dec.Decode(&strict)
+			if tt.canonical && err != nil {
+				t.Errorf("strict Decoder rejected canonical input: %v", err)
+			}
+			if !tt.canonical && err == nil {
+				t.Error("strict Decoder accepted non-canonical input")
+			}
+		})
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		return []byte(strings.Repeat("l", depth) + strings.Repeat("e", depth))
+	}
+
+	tests := []struct {
+		name     string
+		maxDepth int
+		depth    int
+		wantErr  bool
+	}{
+		{"at the limit", 4, 4, false},
+		{"past the limit", 4, 5, true},
+		{"no limit", 0, 1000, false},
+		{"default limit", DefaultMaxDepth, DefaultMaxDepth + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(bytes.NewReader(nested(tt.depth)))
+			dec.MaxDepth = tt.maxDepth
+			var v interface{}
+			err := dec.Decode(&v)
+			if tt.wantErr && err == nil {
+				t.Error("nesting past the limit was accepted")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("nesting within the limit was rejected: %v", err)
+			}
+		})
+	}
+
+	var v interface{}
+	err := Unmarshal(nested(DefaultMaxDepth+1), &v)
+	if err == nil {
+		t.Error("Unmarshal accepted nesting past the default limit")
+	}
+	err = CheckCanonical(nested(DefaultMaxDepth + 1))
+	if err == nil {
+		t.Error("CheckCanonical accepted nesting past the default limit")
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		maxSize int64
+		wantErr bool
+	}{
+		{"string at the limit", "4:spam", 6, false},
+		{"string past the limit", "4:spam", 5, true},
+		{"huge string length", "99999999999:x", 1024, true},
+		{"list past the limit", "li1ei2ei3ee", 8, true},
+		{"integer past the limit", "i12345678e", 4, true},
+		{"no limit", "4:spam", 0, false},
+		{"no limit, string longer than a chunk", "200000:" + strings.Repeat("x", 200000), 0, false},
+		{"no limit, huge string length", "999999999999999:x", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(strings.NewReader(tt.in))
+			dec.MaxSize = tt.maxSize
+			var v interface{}
+			err := dec.Decode(&v)
+			if tt.wantErr && err == nil {
+				t.Error("value past the limit was accepted")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("value within the limit was rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("i1e4:spamle"))
+
+	var n int
+	err := dec.Decode(&n)
+	if err != nil || n != 1 {
+		t.Fatalf("got %d, %v, want 1", n, err)
+	}
+	if dec.InputOffset() != 3 {
+		t.Errorf("offset is %d after the first value, want 3", dec.InputOffset())
+	}
+
+	var s string
+	err = dec.Decode(&s)
+	if err != nil || s != "spam" {
+		t.Fatalf("got %q, %v, want spam", s, err)
+	}
+
+	var l []int
+	err = dec.Decode(&l)
+	if err != nil || l == nil || len(l) != 0 {
+		t.Fatalf("got %v, %v, want an empty list", l, err)
+	}
+
+	err = dec.Decode(&n)
+	if err != io.EOF {
+		t.Errorf("got %v at the end of the stream, want io.EOF", err)
+	}
+}
+
+func TestRawMessageRoundTrip(t *testing.T) {
+	type torrent struct {
+		Announce string     `bencode:"announce"`
+		Info     RawMessage `bencode:"info"`
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		info string
+	}{
+		{"dictionary", "d8:announce3:url4:infod6:lengthi5e4:name1:aee", "d6:lengthi5e4:name1:ae"},
+		// a raw value keeps non-canonical bytes as they were, so the infohash doesn't change
+		{"unsorted dictionary", "d8:announce3:url4:infod4:name1:a6:lengthi5eee", "d4:name1:a6:lengthi5ee"},
+		{"integer", "d8:announce3:url4:infoi-0ee", "i-0e"},
+		{"list", "d8:announce3:url4:infoll1:aeee", "ll1:aee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tor torrent
+			err := Unmarshal([]byte(tt.in), &tor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(tor.Info) != tt.info {
+				t.Errorf("got raw info %q, want %q", tor.Info, tt.info)
+			}
+
+			out, err := Marshal(tor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.in {
+				t.Errorf("got %q back, want %q", out, tt.in)
+			}
+		})
+	}
+
+	// a raw value is copied, so it stays valid when the input changes
+	in := []byte("d8:announce3:url4:infoi1ee")
+	var tor torrent
+	err := Unmarshal(in, &tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(in, bytes.Repeat([]byte{'x'}, len(in)))
+	if string(tor.Info) != "i1e" {
+		t.Errorf("raw value changed with the input: %q", tor.Info)
+	}
+
+	_, err = Marshal(RawMessage{})
+	var unsupported *UnsupportedTypeError
+	if !errors.As(err, &unsupported) {
+		t.Errorf("encoding an empty RawMessage returned %v, want an UnsupportedTypeError", err)
+	}
+}
@@ -0,0 +1,179 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Marshal returns the canonical encoding of v. Map keys and struct fields are
+// written in sorted order. Fields tagged omitempty are left out when they hold
+// their zero value, and so are nil pointer and interface fields since bencode
+// has no null
+func Marshal(v interface{}) ([]byte, error) {
+	e := encodeState{}
+	err := e.value(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
+}
+
+// Encoder writes bencoded values to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an Encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the encoding of v to the stream
+func (enc *Encoder) Encode(v interface{}) error {
+	b, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = enc.w.Write(b)
+	return err
+}
+
+type encodeState struct {
+	bytes.Buffer
+}
+
+func (e *encodeState) value(v reflect.Value) error {
+	if !v.IsValid() {
+		return &UnsupportedTypeError{nil}
+	}
+	if v.Type() == rawMessageType {
+		if len(v.Bytes()) == 0 {
+			return &UnsupportedTypeError{v.Type()}
+		}
+		e.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.WriteByte('i')
+		e.WriteString(strconv.FormatInt(v.Int(), 10))
+		e.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.WriteByte('i')
+		e.WriteString(strconv.FormatUint(v.Uint(), 10))
+		e.WriteByte('e')
+	case reflect.Bool:
+		// no booleans in bencode, 0 and 1 is what everyone uses
+		if v.Bool() {
+			e.WriteString("i1e")
+		} else {
+			e.WriteString("i0e")
+		}
+	case reflect.String:
+		e.str([]byte(v.String()))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.str(v.Bytes())
+			return nil
+		}
+		return e.list(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.str(b)
+			return nil
+		}
+		return e.list(v)
+	case reflect.Map:
+		return e.dict(v)
+	case reflect.Struct:
+		return e.structValue(v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &UnsupportedTypeError{v.Type()}
+		}
+		return e.value(v.Elem())
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
+	return nil
+}
+
+func (e *encodeState) str(b []byte) {
+	e.WriteString(strconv.Itoa(len(b)))
+	e.WriteByte(':')
+	e.Write(b)
+}
+
+func (e *encodeState) list(v reflect.Value) error {
+	e.WriteByte('l')
+	for i := 0; i < v.Len(); i++ {
+		err := e.value(v.Index(i))
+		if err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+func (e *encodeState) dict(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{v.Type()}
+	}
+
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	e.WriteByte('d')
+	for _, k := range keys {
+		e.str([]byte(k.String()))
+		err := e.value(v.MapIndex(k))
+		if err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+func (e *encodeState) structValue(v reflect.Value) error {
+	e.WriteByte('d')
+	for _, f := range cachedFields(v.Type()).list {
+		fv := v.Field(f.index)
+		if (fv.Kind() == reflect.Pointer || fv.Kind() == reflect.Interface) && fv.IsNil() {
+			continue
+		}
+		if f.omitEmpty && isEmpty(fv) {
+			continue
+		}
+
+		e.str([]byte(f.name))
+		err := e.value(fv)
+		if err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	case reflect.Array:
+		return v.IsZero()
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
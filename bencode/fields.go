@@ -0,0 +1,70 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// structFields are the encodable fields of a struct type, sorted by name so
+// they are written in canonical order
+type structFields struct {
+	list   []field
+	byName map[string]int //index into list
+}
+
+var fieldCache sync.Map // map[reflect.Type]*structFields
+
+func cachedFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.(*structFields)
+}
+
+func typeFields(t reflect.Type) *structFields {
+	fs := &structFields{byName: make(map[string]int)}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		fs.list = append(fs.list, field{
+			name:      name,
+			index:     i,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+
+	sort.SliceStable(fs.list, func(i, j int) bool {
+		return fs.list[i].name < fs.list[j].name
+	})
+	// two fields with the same name would make a dictionary with duplicate keys, the first one wins
+	unique := fs.list[:0]
+	for _, f := range fs.list {
+		if _, dup := fs.byName[f.name]; dup {
+			continue
+		}
+		fs.byName[f.name] = len(unique)
+		unique = append(unique, f)
+	}
+	fs.list = unique
+	return fs
+}
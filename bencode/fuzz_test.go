@@ -0,0 +1,104 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// the seed corpus is in testdata/fuzz. Run with go test -fuzz=FuzzUnmarshal ./bencode
+
+func FuzzUnmarshal(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v interface{}
+		err := Unmarshal(data, &v)
+		if err != nil {
+			return
+		}
+
+		// a raw value is exactly the input
+		var raw RawMessage
+		err = Unmarshal(data, &raw)
+		if err != nil {
+			t.Fatalf("decoded into interface{} but not into RawMessage: %v", err)
+		}
+		if !bytes.Equal(raw, data) {
+			t.Fatalf("raw value %q differs from input %q", raw, data)
+		}
+
+		// whatever we decoded encodes to canonical form, which decodes to the same value
+		out, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("could not encode decoded value %#v: %v", v, err)
+		}
+		err = CheckCanonical(out)
+		if err != nil {
+			t.Fatalf("encoded %q is not canonical: %v", out, err)
+		}
+		var again interface{}
+		err = Unmarshal(out, &again)
+		if err != nil {
+			t.Fatalf("could not decode encoded %q: %v", out, err)
+		}
+		if !reflect.DeepEqual(v, again) {
+			t.Fatalf("round trip changed %#v into %#v", v, again)
+		}
+
+		// and canonical input comes back byte for byte
+		if CheckCanonical(data) == nil && !bytes.Equal(out, data) {
+			t.Fatalf("canonical %q encoded back as %q", data, out)
+		}
+
+		// typed decoding may fail, but must not panic
+		var tor struct {
+			Announce string                `bencode:"announce"`
+			Info     RawMessage            `bencode:"info"`
+			Length   int                   `bencode:"length"`
+			Pieces   []byte                `bencode:"pieces"`
+			Hash     [20]byte              `bencode:"hash"`
+			List     [][]string            `bencode:"announce-list"`
+			Private  *bool                 `bencode:"private"`
+			Extra    map[string]RawMessage `bencode:"extra"`
+		}
+		Unmarshal(data, &tor)
+	})
+}
+
+func FuzzDecoder(f *testing.F) {
+	const maxSize = 1024
+	const maxDepth = 8
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, strict := range []bool{false, true} {
+			dec := NewDecoder(bytes.NewReader(data))
+			dec.MaxSize = maxSize
+			dec.MaxDepth = maxDepth
+			dec.Strict = strict
+
+			// values are read back to back, so together they are the start of the input
+			consumed := []byte{}
+			for {
+				var raw RawMessage
+				err := dec.Decode(&raw)
+				if err != nil {
+					break
+				}
+				if len(raw) > maxSize {
+					t.Fatalf("read a value of %d bytes with a limit of %d", len(raw), maxSize)
+				}
+				if strict {
+					err = CheckCanonical(raw)
+					if err != nil {
+						t.Fatalf("strict Decoder returned non-canonical %q: %v", raw, err)
+					}
+				}
+
+				consumed = append(consumed, raw...)
+				offset := dec.InputOffset()
+				if offset > int64(len(data)) || !bytes.Equal(consumed, data[:offset]) {
+					t.Fatalf("values %q don't match the %d bytes consumed of %q", consumed, offset, data)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// Decoder reads bencoded values one after another from a stream. Values are
+// read in full before they are decoded, MaxSize and MaxDepth bound how much
+// memory one value may take
+type Decoder struct {
+	r *bufio.Reader
+
+	//how deeply lists and dictionaries may nest, 0 means no limit
+	MaxDepth int
+	//the largest value, in bytes, that will be read. 0 means no limit
+	MaxSize int64
+	//reject input that isn't in canonical form
+	Strict bool
+
+	offset int64
+	buf    []byte
+}
+
+// NewDecoder returns a Decoder reading from r with the default limits
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br, MaxDepth: DefaultMaxDepth, MaxSize: DefaultMaxSize}
+}
+
+// Decode reads the next value from the stream and decodes it into the value v points to
+func (dec *Decoder) Decode(v interface{}) error {
+	start := dec.offset
+	data, err := dec.readValue()
+	if err != nil {
+		return err
+	}
+
+	d := decodeState{data: data, base: start, maxDepth: dec.MaxDepth, strict: dec.Strict}
+	return d.unmarshal(v)
+}
+
+// InputOffset returns how many bytes of the stream have been decoded so far
+func (dec *Decoder) InputOffset() int64 {
+	return dec.offset
+}
+
+// Buffered returns a reader of the data that has been read from the stream
+// but not decoded yet
+func (dec *Decoder) Buffered() io.Reader {
+	b, _ := dec.r.Peek(dec.r.Buffered())
+	return bytes.NewReader(b)
+}
+
+func (dec *Decoder) syntaxError(msg string) error {
+	return &SyntaxError{msg: msg, Offset: dec.offset}
+}
+
+func (dec *Decoder) readByte() (byte, error) {
+	c, err := dec.r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(dec.buf) > 0 {
+			return 0, dec.syntaxError("unexpected end of input")
+		}
+		return 0, err
+	}
+	if dec.MaxSize > 0 && int64(len(dec.buf)) >= dec.MaxSize {
+		return 0, dec.syntaxError("value larger than " + strconv.FormatInt(dec.MaxSize, 10) + " bytes")
+	}
+	dec.buf = append(dec.buf, c)
+	dec.offset++
+	return c, nil
+}
+
+// readValue copies the bytes of the next value out of the stream. It only
+// checks the structure, decodeState does the rest
+func (dec *Decoder) readValue() ([]byte, error) {
+	dec.buf = dec.buf[:0]
+	depth := 0
+	for {
+		c, err := dec.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case c == 'i':
+			for c != 'e' {
+				c, err = dec.readByte()
+				if err != nil {
+					return nil, err
+				}
+			}
+		case isDigit(c):
+			length := int64(c - '0')
+			for {
+				c, err = dec.readByte()
+				if err != nil {
+					return nil, err
+				}
+				if c == ':' {
+					break
+				}
+				if !isDigit(c) || length > (1<<53) {
+					return nil, dec.syntaxError("invalid string length")
+				}
+				length = length*10 + int64(c-'0')
+			}
+			err = dec.readString(length)
+			if err != nil {
+				return nil, err
+			}
+		case c == 'l' || c == 'd':
+			depth++
+			if dec.MaxDepth > 0 && depth > dec.MaxDepth {
+				return nil, dec.syntaxError("exceeded max depth of " + strconv.Itoa(dec.MaxDepth))
+			}
+			continue
+		case c == 'e' && depth > 0:
+			depth--
+		default:
+			return nil, &SyntaxError{msg: "unexpected byte " + strconv.QuoteRune(rune(c)), Offset: dec.offset - 1}
+		}
+
+		if depth == 0 {
+			return dec.buf, nil
+		}
+	}
+}
+
+// stringChunk is how much of a string is read at a time. The length prefix
+// comes from the stream, so memory only grows as the bytes actually arrive
+const stringChunk = 64 * 1024
+
+// readString copies a string body of length bytes
+func (dec *Decoder) readString(length int64) error {
+	if dec.MaxSize > 0 && int64(len(dec.buf))+length > dec.MaxSize {
+		return dec.syntaxError("value larger than " + strconv.FormatInt(dec.MaxSize, 10) + " bytes")
+	}
+
+	for length > 0 {
+		chunk := int(min(length, stringChunk))
+		start := len(dec.buf)
+		dec.buf = slices.Grow(dec.buf, chunk)[:start+chunk]
+		n, err := io.ReadFull(dec.r, dec.buf[start:])
+		dec.offset += int64(n)
+		if err != nil {
+			dec.buf = dec.buf[:start+n]
+			return dec.syntaxError("string runs past the end of input")
+		}
+		length -= int64(n)
+	}
+	return nil
+}
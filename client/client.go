@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/Richd0tcom/bookish-chainsaw/bitfield"
+	"github.com/Richd0tcom/bookish-chainsaw/extension"
 	"github.com/Richd0tcom/bookish-chainsaw/handshake"
 	"github.com/Richd0tcom/bookish-chainsaw/message"
 	"github.com/Richd0tcom/bookish-chainsaw/peers"
@@ -18,9 +20,28 @@ type Client struct {
 	// Conn     net.Conn
 	Choked   bool
 	Bitfield bitfield.Bitfield
+
+	//reserved bits the peer sent in its handshake
+	Reserved [8]byte
+
+	//the peer's extension handshake. nil until it arrives or if the peer doesn't support extensions.
+	//use ExtensionHandshake when another goroutine may be reading
+	Extensions *extension.Handshake
+	extMu      sync.Mutex
+
 	peer     peers.Peer
 	infoHash [20]byte
 	peerID   [20]byte
+
+	//the port peers can connect to us on, sent in our extension handshake. 0 if we don't listen
+	listenPort uint16
+	//size of the info dictionary we serve through ut_metadata. 0 if we don't have it
+	metadataSize int
+	//private torrents keep ut_pex out of our extension handshake (BEP 27)
+	private bool
+
+	//serializes writes, since uploads and downloads share the connection
+	writeMu sync.Mutex
 }
 
 func shakeHands(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Handshake, error){
@@ -49,27 +70,56 @@ func shakeHands(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Handshake,
 
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{}) // Disable the deadline
+// reads messages until the peer's bitfield arrives. Extension handshakes may come before it
+func (c *Client) recvBitfield() (bitfield.Bitfield, error) {
+	c.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
 
-	
-	msg, err := message.Read(conn)
-	if err != nil {
-		return nil, err
+	for {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			err := fmt.Errorf("Expected bitfield but got keep-alive")
+			return nil, err
+		}
+		if msg.ID == message.MSG_EXTENDED {
+			continue
+		}
+		if msg.ID != message.MSG_BITFIELD {
+			err := fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
+			return nil, err
+		}
+
+		return msg.Payload, nil
 	}
-	if msg == nil {
-		err := fmt.Errorf("Expected bitfield but got %s", msg.ID)
+}
+
+// New connects to a peer to download from it and waits for its bitfield.
+// listenPort is where peers can connect to us, 0 if we don't listen. metadataSize
+// is the size of the info dictionary we can send, 0 if we don't have it. private
+// leaves PEX out of the extensions we offer
+func New(p peers.Peer, infoHash [20]byte, peerID [20]byte, listenPort uint16, metadataSize int, private bool) (*Client, error) {
+	c, err := Dial(p, infoHash, peerID, listenPort, metadataSize, private)
+	if err != nil {
 		return nil, err
 	}
-	if msg.ID != message.MSG_BITFIELD {
-		err := fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
+
+	// receive bitfield
+	c.Bitfield, err = c.recvBitfield()
+	if err != nil {
+		c.Conn.Close()
 		return nil, err
 	}
 
-	return msg.Payload, nil
+	return c, nil
 }
-func New(p peers.Peer, infoHash [20]byte, peerID [20]byte) (*Client, error) {
+
+// Dial connects to a peer and swaps handshakes, and extension handshakes if the
+// peer supports them. Unlike New it doesn't wait for a bitfield, peers that
+// have no pieces yet may never send one
+func Dial(p peers.Peer, infoHash [20]byte, peerID [20]byte, listenPort uint16, metadataSize int, private bool) (*Client, error) {
 	// connect to peer
 	conn, err := net.DialTimeout("tcp", p.String(), 3*time.Second)
 
@@ -78,73 +128,232 @@ func New(p peers.Peer, infoHash [20]byte, peerID [20]byte) (*Client, error) {
 	}
 
     // send and receive handshake
-	_, err= shakeHands(conn, infoHash, peerID)
+	hs, err:= shakeHands(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	// receive bitfield
-	bf, err := recvBitfield(conn)
+	c := &Client{
+		Conn:     conn,
+		Choked:   true,
+		Reserved: hs.Reserved,
+		peer:     p,
+		infoHash: infoHash,
+		peerID:   peerID,
+
+		listenPort:   listenPort,
+		metadataSize: metadataSize,
+		private:      private,
+	}
+
+	if hs.SupportsExtensions() {
+		err = c.SendExtendedHandshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Accept completes the handshake for a connection a peer opened to us on listenPort.
+// lookup returns the peer ID we use for an infohash, the size of its info
+// dictionary and whether it is private, or false if we don't serve it
+func Accept(conn net.Conn, listenPort uint16, lookup func(infoHash [20]byte) ([20]byte, int, bool, bool)) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	theirs := handshake.Handshake{}
+	err := theirs.Read(conn)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	return &Client{
+	peerID, metadataSize, private, ok := lookup(theirs.InfoHash)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("peer asked for unknown infohash %x", theirs.InfoHash)
+	}
+
+	ours := handshake.New(theirs.InfoHash, peerID)
+	_, err = conn.Write(ours.Serialize())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p := peers.Peer{}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		p = peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+
+	c := &Client{
 		Conn:     conn,
 		Choked:   true,
-		Bitfield: bf,
+		Reserved: theirs.Reserved,
 		peer:     p,
-		infoHash: infoHash,
+		infoHash: theirs.InfoHash,
 		peerID:   peerID,
-	}, nil
 
+		listenPort:   listenPort,
+		metadataSize: metadataSize,
+		private:      private,
+	}
+
+	if theirs.SupportsExtensions() {
+		err = c.SendExtendedHandshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
 }
 
-// func (c *client) Piece(index int, begin, length int) []byte
-// func (c *client) Cancel(index, begin, length int)
+// InfoHash returns the infohash the connection is for
+func (c *Client) InfoHash() [20]byte {
+	return c.infoHash
+}
 
 
 
-// Read reads and consumes a message from the connection
+
+// Read reads and consumes a message from the connection.
+// Extension handshakes are also stored on the client
 func (c *Client) Read() (*message.Message, error) {
 	msg, err := message.Read(c.Conn)
-	return msg, err
+	if err != nil || msg == nil || msg.ID != message.MSG_EXTENDED {
+		return msg, err
+	}
+
+	extID, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return nil, err
+	}
+	if extID == extension.HandshakeID {
+		ext, err := extension.Parse(payload)
+		if err != nil {
+			return nil, err
+		}
+		c.extMu.Lock()
+		c.Extensions = ext
+		c.extMu.Unlock()
+	}
+	return msg, nil
+}
+
+// SupportsExtensions reports whether the peer set the extension protocol bit in its handshake
+func (c *Client) SupportsExtensions() bool {
+	hs := handshake.Handshake{Reserved: c.Reserved}
+	return hs.SupportsExtensions()
+}
+
+// ExtensionHandshake returns the peer's extension handshake, or nil if it hasn't sent one
+func (c *Client) ExtensionHandshake() *extension.Handshake {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+
+	return c.Extensions
+}
+
+// SupportsExtension reports whether the peer has told us it understands the named extension
+func (c *Client) SupportsExtension(name string) bool {
+	ext := c.ExtensionHandshake()
+	if ext == nil {
+		return false
+	}
+	_, err := ext.ID(name)
+	return err == nil
+}
+
+// SendExtendedHandshake sends our extension handshake to the peer
+func (c *Client) SendExtendedHandshake() error {
+	ext := extension.New(c.metadataSize, c.listenPort)
+	if c.private {
+		ext.Disable(extension.UTPex)
+	}
+	payload, err := ext.Serialize()
+	if err != nil {
+		return err
+	}
+	return c.send(message.FormatExtended(extension.HandshakeID, payload))
+}
+
+// SendExtended sends an extended message for the named extension using the ID the peer asked for
+func (c *Client) SendExtended(name string, payload []byte) error {
+	ext := c.ExtensionHandshake()
+	if ext == nil {
+		return fmt.Errorf("peer has not sent an extension handshake")
+	}
+	id, err := ext.ID(name)
+	if err != nil {
+		return err
+	}
+	return c.send(message.FormatExtended(id, payload))
 }
 
 // Request sends a Request message to the peer
 func (c *Client) Request(index, begin, length int) error {
 	req := message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	return err
+	return c.send(req)
+}
+
+// Cancel sends a Cancel message for a block we requested earlier
+func (c *Client) Cancel(index, begin, length int) error {
+	return c.send(message.FormatCancel(index, begin, length))
 }
 
 // Interested sends an Interested message to the peer
 func (c *Client) Interested() error {
-	msg := message.Message{ID: message.MSG_INTERESTED}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MSG_INTERESTED})
 }
 
 // NotInterested sends a NotInterested message to the peer
 func (c *Client) NotInterested() error {
-	msg := message.Message{ID: message.MSG_NOT_INTERESTED}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MSG_NOT_INTERESTED})
 }
 
 // Unchoke sends an Unchoke message to the peer
 func (c *Client) Unchoke() error {
-	msg := message.Message{ID: message.MSG_UNCHOKE}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MSG_UNCHOKE})
 }
 
 // SendHave sends a Have message to the peer
 func (c *Client) SendHave(index int) error {
-	msg := message.FormatHave(index)
+	return c.send(message.FormatHave(index))
+}
+
+// Choke sends a Choke message to the peer
+func (c *Client) Choke() error {
+	return c.send(&message.Message{ID: message.MSG_CHOKE})
+}
+
+// SendBitfield sends our bitfield to the peer
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	return c.send(&message.Message{ID: message.MSG_BITFIELD, Payload: bf})
+}
+
+// SendPiece sends a block of a piece to the peer
+func (c *Client) SendPiece(index, begin int, data []byte) error {
+	return c.send(message.FormatPiece(index, begin, data))
+}
+
+// KeepAlive sends a keep-alive message so the peer doesn't drop an idle connection
+func (c *Client) KeepAlive() error {
+	var msg *message.Message
+	return c.send(msg)
+}
+
+// Peer returns the address of the peer
+func (c *Client) Peer() peers.Peer {
+	return c.peer
+}
+
+func (c *Client) send(msg *message.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
-
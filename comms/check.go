@@ -0,0 +1,110 @@
+package comms
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bitfield"
+	"github.com/Richd0tcom/bookish-chainsaw/storage"
+)
+
+// PieceStatus is what VerifyPieces found out about a piece
+type PieceStatus int
+
+const (
+	PieceGood    PieceStatus = iota
+	PieceBad                 //failed the integrity check
+	PieceMissing             //could not be read, its files are missing or too short
+)
+
+func (s PieceStatus) String() string {
+	switch s {
+	case PieceGood:
+		return "good"
+	case PieceBad:
+		return "bad"
+	case PieceMissing:
+		return "missing"
+	default:
+		return "unknown"
+	}
+}
+
+// VerifyPieces hashes every piece read from st in parallel and checks it the
+// same way downloaded pieces are checked. Hashes past the end of the data are bad
+func VerifyPieces(st storage.Torrent, hashes [][20]byte, pieceLength, length int) []PieceStatus {
+	status := make([]PieceStatus, len(hashes))
+	if pieceLength <= 0 {
+		for index := range status {
+			status[index] = PieceBad
+		}
+		return status
+	}
+	indexes := make(chan int)
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for index := range indexes {
+				size := min(pieceLength, length-index*pieceLength)
+				if size <= 0 {
+					status[index] = PieceBad
+					continue
+				}
+				_, err := st.ReadPiece(index, 0, buf[:size])
+				if err != nil {
+					status[index] = PieceMissing
+					continue
+				}
+				pw := &pieceWork{index, hashes[index], size}
+				if checkIntegrity(pw, buf[:size]) != nil {
+					status[index] = PieceBad
+				}
+			}
+		}()
+	}
+
+	for index := range hashes {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	return status
+}
+
+// Check hashes the pieces already in Storage and marks the good ones as done,
+// so Download only fetches the rest. It returns the number of good pieces
+func (t *Torrent) Check() int {
+	status := VerifyPieces(t.Storage, t.PieceHashes, t.PieceLength, t.Length)
+
+	bf := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	count := 0
+	for index, s := range status {
+		if s == PieceGood {
+			bf.SetPiece(index)
+			count++
+		}
+	}
+	t.MarkHave(bf)
+	return count
+}
+
+// MarkHave records pieces we already have, e.g. from a resume file, so Download skips them
+func (t *Torrent) MarkHave(bf bitfield.Bitfield) {
+	picker := t.getPicker()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.initHave()
+	for index := range t.PieceHashes {
+		if bf.HasPiece(index) {
+			t.have.SetPiece(index)
+			picker.finish(index)
+		}
+	}
+}
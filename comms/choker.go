@@ -0,0 +1,128 @@
+package comms
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// ChokeInterval is how often we decide who to upload to
+const ChokeInterval = 10 * time.Second
+
+// OptimisticInterval is how often the optimistic unchoke moves to another peer
+const OptimisticInterval = 30 * time.Second
+
+// UploadSlots is the number of peers unchoked for their rates, on top of the optimistic unchoke
+var UploadSlots = 4
+
+// choker implements tit-for-tat like the mainline client. Every round it unchokes
+// the interested peers that gave us the most (or took the most once we are seeding)
+// and one randomly picked peer, so newcomers get a chance to prove themselves
+type choker struct {
+	t *Torrent
+
+	//counters at the last round, so we can work out rates
+	lastDownloaded map[*peerConn]int64
+	lastUploaded   map[*peerConn]int64
+
+	optimistic *peerConn
+	rounds     int
+}
+
+func newChoker(t *Torrent) *choker {
+	return &choker{
+		t:              t,
+		lastDownloaded: make(map[*peerConn]int64),
+		lastUploaded:   make(map[*peerConn]int64),
+	}
+}
+
+// run rechokes every ChokeInterval until stop is closed
+func (ch *choker) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(ChokeInterval)
+	defer ticker.Stop()
+
+	ch.rechoke()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ch.rechoke()
+		}
+	}
+}
+
+type rated struct {
+	pc   *peerConn
+	rate int64
+}
+
+func (ch *choker) rechoke() {
+	conns := ch.t.connections()
+	// with pieces skipped by priority we are seeding once the wanted ones are in
+	seeding := ch.t.wantedLeft(ch.t.getPicker()) == 0
+
+	// how many bytes moved since the last round
+	current := make(map[*peerConn]bool, len(conns))
+	interested := []rated{}
+	for _, pc := range conns {
+		current[pc] = true
+
+		downloaded := pc.downloaded.Load()
+		uploaded := pc.uploaded.Load()
+		rate := downloaded - ch.lastDownloaded[pc]
+		if seeding {
+			rate = uploaded - ch.lastUploaded[pc]
+		}
+		ch.lastDownloaded[pc] = downloaded
+		ch.lastUploaded[pc] = uploaded
+
+		if pc.isInterested() {
+			interested = append(interested, rated{pc, rate})
+		}
+	}
+
+	// forget peers that went away
+	for pc := range ch.lastDownloaded {
+		if !current[pc] {
+			delete(ch.lastDownloaded, pc)
+			delete(ch.lastUploaded, pc)
+		}
+	}
+	if ch.optimistic != nil && !current[ch.optimistic] {
+		ch.optimistic = nil
+	}
+
+	sort.Slice(interested, func(i, j int) bool {
+		return interested[i].rate > interested[j].rate
+	})
+
+	unchoke := make(map[*peerConn]bool)
+	for i := 0; i < len(interested) && i < UploadSlots; i++ {
+		unchoke[interested[i].pc] = true
+	}
+
+	// the optimistic unchoke moves every OptimisticInterval to a peer that isn't already unchoked
+	roundsPerOptimistic := int(OptimisticInterval / ChokeInterval)
+	if ch.optimistic == nil || unchoke[ch.optimistic] || ch.rounds%roundsPerOptimistic == 0 {
+		candidates := []*peerConn{}
+		for _, r := range interested {
+			if !unchoke[r.pc] {
+				candidates = append(candidates, r.pc)
+			}
+		}
+		ch.optimistic = nil
+		if len(candidates) > 0 {
+			ch.optimistic = candidates[rand.Intn(len(candidates))]
+		}
+	}
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+	ch.rounds++
+
+	for _, pc := range conns {
+		pc.setChoking(!unchoke[pc])
+	}
+}
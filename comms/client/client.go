@@ -60,7 +60,7 @@ func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
 		return nil, err
 	}
 	if msg == nil {
-		err := fmt.Errorf("Expected bitfield but got %s", msg.ID)
+		err := fmt.Errorf("Expected bitfield but got keep-alive")
 		return nil, err
 	}
 	if msg.ID != message.MSG_BITFIELD {
@@ -3,13 +3,19 @@ package comms
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Richd0tcom/bookish-chainsaw/bitfield"
 	"github.com/Richd0tcom/bookish-chainsaw/client"
 	"github.com/Richd0tcom/bookish-chainsaw/message"
 	"github.com/Richd0tcom/bookish-chainsaw/peers"
+	"github.com/Richd0tcom/bookish-chainsaw/storage"
 
 	
 )
@@ -20,6 +26,9 @@ const MaxBlockSize = 16384 //16KB
 // MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
 const MaxBacklog = 5
 
+// ErrStopped is returned by Download when the torrent is closed before it finishes
+var ErrStopped = errors.New("torrent stopped")
+
 
 type Torrent struct {
 	PieceHashes [][20]byte 
@@ -30,6 +39,38 @@ type Torrent struct {
 	Length int 
 	PieceLength int //length of a piece
 	Name        string
+
+	//where verified pieces are written as they come in and read from when uploading
+	Storage storage.Torrent
+
+	//port peers can connect to us on, told to peers so PEX can pass it on. 0 if we don't listen
+	ListenPort uint16
+
+	//the bencoded info dictionary, served to peers that fetch it through ut_metadata. nil if we don't have it
+	RawInfo []byte
+
+	//private torrents only get peers from trackers, so we don't swap peers through PEX (BEP 27)
+	Private bool
+
+	//limits shared with other torrents. nil means no limit
+	DownloadLimit *RateLimiter
+	UploadLimit   *RateLimiter
+	ConnLimit     *ConnLimit
+
+	mu    sync.Mutex
+	have  bitfield.Bitfield    //pieces we have verified
+	picker *picker
+	active map[int]*activePiece //pieces being downloaded
+	conns map[*peerConn]bool   //connections we may upload to
+	connMgr *connManager
+
+	uploaded   atomic.Int64
+	downloaded atomic.Int64 //bytes of verified pieces we downloaded
+
+	chokerOnce sync.Once
+	stop       chan struct{}
+	stopOnce   sync.Once
+	workers    sync.WaitGroup //goroutines that read Storage, Close waits for them
 }
 
 type pieceWork struct {
@@ -46,41 +87,52 @@ type pieceResult struct {
 type pieceProgress struct {
     index      int
     client     *client.Client
-    buf        []byte
-    downloaded int
-    requested  int
-    backlog    int
+    conn       *peerConn
+    piece      *activePiece
+    requested  map[int]int //blocks we asked this peer for, by offset
 }
 
-func (state *pieceProgress) readMessage() error {
-    msgg, err := state.client.Read() // this call blocks
-    if err != nil {
-		return err
-	}
+func (state *pieceProgress) readMessage(deadline <-chan time.Time) error {
+    var msgg *message.Message
+    select {
+    case m, ok := <-state.conn.msgs: // blocks until the peer says something
+        if !ok {
+            return state.conn.readErr
+        }
+        msgg = m
+    case <-state.piece.finished: // another peer delivered the last block
+        return nil
+    case <-deadline:
+        return fmt.Errorf("timed out downloading piece %d", state.index)
+    }
 
     if msgg == nil { // keep-alive
 		return nil
 	}
     switch msgg.ID {
-		case message.MSG_UNCHOKE:
-			state.client.Choked = false
-		case message.MSG_CHOKE:
-			state.client.Choked = true
-		case message.MSG_HAVE:
-			index, err := message.ParseHave(msgg)
-
-			if err != nil {
-				return err
-			}
-			state.client.Bitfield.SetPiece(index)
 		case message.MSG_PIECE:
-			n, err := message.ParsePiece(state.index, state.buf, msgg)
+			if len(msgg.Payload) >= 4 && int(binary.BigEndian.Uint32(msgg.Payload[0:4])) != state.index {
+				return nil // a block of a piece we gave up on or cancelled
+			}
+			begin, n, others, err := state.piece.receive(state.conn, msgg)
 			if err != nil {
 				return err
 			}
 
-			state.downloaded += n
-			state.backlog--
+			delete(state.requested, begin)
+			state.conn.downloaded.Add(int64(n))
+
+			// endgame: nobody else needs to send this block any more
+			for _, other := range others {
+				other.c.Cancel(state.index, begin, n)
+			}
+		case message.MSG_CHOKE:
+			// a choking peer drops our requests, ask again once unchoked
+			state.requested = make(map[int]int)
+			state.piece.leave(state.conn)
+			return state.conn.handleMessage(msgg)
+		default:
+			return state.conn.handleMessage(msgg)
     }
     return nil
 }
@@ -98,40 +150,58 @@ func (t *Torrent) calculatePieceSize(index int) int {
 
 
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
+func (t *Torrent) attemptDownloadPiece(pc *peerConn, pw *pieceWork) ([]byte, error) {
+    c := pc.c
     state := pieceProgress{
-        index:  pw.Index,
-        client: c,
-        buf:    make([]byte, pw.Length),
+        index:     pw.Index,
+        client:    c,
+        conn:      pc,
+        piece:     t.activePiece(pw.Index, pw.Length),
+        requested: make(map[int]int),
     }
+    defer state.piece.leave(pc)
 
     // Setting a deadline helps get unresponsive peers unstuck.
     // 30 seconds is more than enough time to download a 262 KB piece
-    c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-    defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
+    deadline := time.After(30 * time.Second)
+
+    for !state.piece.isFinished() {
+        // blocks another peer delivered no longer count against our backlog
+        for begin := range state.requested {
+            if state.piece.has(begin) {
+                delete(state.requested, begin)
+            }
+        }
 
-    for state.downloaded < pw.Length {
         // If unchoked, send requests until we have enough unfulfilled requests
         if !state.client.Choked {
-            for state.backlog < MaxBacklog && state.requested < pw.Length {
-                blockSize := min(pw.Length - state.requested, MaxBlockSize)
+            for len(state.requested) < MaxBacklog {
+                begin, blockSize, ok := state.piece.nextBlock(pc)
+                if !ok {
+                    break
+                }
+                t.DownloadLimit.Wait(blockSize)
 
-                err := c.Request(pw.Index, state.requested, blockSize)
+                err := c.Request(pw.Index, begin, blockSize)
                 if err != nil {
                     return nil, err
                 }
-                state.backlog++
-                state.requested += blockSize
+                state.requested[begin] = blockSize
             }
         }
 
-        err := state.readMessage()
+        err := state.readMessage(deadline)
         if err != nil {
             return nil, err
         }
     }
 
-    return state.buf, nil
+    // in endgame mode several peers finish the piece at once, only one of them hands it in
+    buf, ok := state.piece.claim()
+    if !ok {
+        return nil, nil
+    }
+    return buf, nil
 }
 
 func checkIntegrity(pw *pieceWork, buf []byte) error {
@@ -143,71 +213,436 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, t.InfoHash, t.PeerID )
+func (t *Torrent) startDownloadWorker(peer peers.Peer, results chan *pieceResult) {
+	c, err := client.New(peer, t.InfoHash, t.PeerID, t.ListenPort, len(t.RawInfo), t.Private)
     if err != nil {
         log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
         return
     }
 
 	defer c.Conn.Close()
+	if t.stopped() {
+		return
+	}
     log.Printf("Completed handshake with %s\n", peer.IP)
 
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.Index) {
-			workQueue<- pw // Put piece back on the queue
+	pc := t.addConn(c, true)
+	defer t.removeConn(pc)
+	t.spawn(pc.uploadLoop)
+	go pc.readLoop()
+	if !t.Private {
+		go pc.pexLoop()
+	}
+
+	// peers won't unchoke us unless we tell them we want something
+	err = c.Interested()
+	if err != nil {
+		return
+	}
+
+	picker := t.getPicker()
+	for picker.remaining() > 0 && !t.stopped() {
+		index := picker.pick(c.Bitfield)
+		if index == -1 {
+			// the peer has nothing we need right now, listen for HAVEs until it does
+			err = pc.waitForPieces()
+			if err != nil {
+				return
+			}
+			continue
 		}
+		pw := &pieceWork{index, t.PieceHashes[index], t.calculatePieceSize(index)}
 
 		// Download the piece
-        buf, err := attemptDownloadPiece(c, pw)
+        buf, err := t.attemptDownloadPiece(pc, pw)
         if err != nil {
             log.Println("Exiting", err)
-            workQueue <- pw // Put piece back on the queue
+            picker.abort(pw.Index) // Put piece back up for grabs
             return
         }
+        if buf == nil {
+            continue // another peer finished it first
+        }
 
 		err = checkIntegrity(pw, buf)
 		if err != nil {
             log.Printf("Piece #%d failed integrity check\n", pw.Index)
-            workQueue <- pw // Put piece back on the queue
+            t.dropActivePiece(pw.Index)
+            picker.reset(pw.Index) // Put piece back up for grabs
             continue
         }
 
-		c.SendHave(pw.Index)
-        results <- &pieceResult{pw.Index, buf}
+		// finish first, so a peer that lost the race can't pick the piece again
+		// and start over on a fresh activePiece
+		picker.finish(pw.Index)
+		t.dropActivePiece(pw.Index)
+		select {
+		case results <- &pieceResult{pw.Index, buf}:
+		case <-t.stopChan():
+			return
+		}
 	}
 } 
 
+// SetPiecePriority changes how eagerly a piece is downloaded. PriorityNone skips it
+func (t *Torrent) SetPiecePriority(index, priority int) {
+	t.getPicker().setPriority(index, priority)
+}
 
-func (t *Torrent) Download() ([]byte, error){
-
+// Download fetches every wanted piece from peers and writes each one to Storage as
+// soon as it passes its integrity check. Only pieces in flight are kept in memory
+func (t *Torrent) Download() error {
+	if t.Storage == nil {
+		return fmt.Errorf("torrent %x has no storage to download into", t.InfoHash)
+	}
 
-	// Init queues for workers to retrieve work and send results
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
+	// Init the picker and a queue for workers to send results
+	picker := t.getPicker()
 	results := make(chan *pieceResult)
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+
+	t.startChoker()
+
+	// Start workers. Peers added later get one too
+	t.AddPeers(t.Peers)
+	go t.dialLoop(results)
+
+	// Write results to storage until every wanted piece is in
+	stop := t.stopChan()
+	for t.wantedLeft(picker) > 0 {
+		var res *pieceResult
+		select {
+		case res = <-results:
+		case <-picker.changed:
+			continue // priorities changed, maybe we are done now
+		case <-stop:
+			return ErrStopped
+		}
+		if t.hasPiece(res.index) {
+			continue // endgame delivered it twice
+		}
+		_, err := t.Storage.WritePiece(res.index, 0, res.buf)
+		if err != nil {
+			return err
+		}
+		err = t.Storage.MarkComplete(res.index)
+		if err != nil {
+			return err
+		}
+		t.downloaded.Add(int64(len(res.buf)))
+		t.markHave(res.index)
+
+		//TODO: Add download percentage logging
+	}
+
+	return nil
+}
+
+// Uploaded returns the number of bytes we have sent to peers
+func (t *Torrent) Uploaded() int64 {
+	return t.uploaded.Load()
+}
+
+// Downloaded returns the number of bytes of verified pieces we got from peers
+func (t *Torrent) Downloaded() int64 {
+	return t.downloaded.Load()
+}
+
+// Left returns the number of bytes we still need to download
+func (t *Torrent) Left() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	left := int64(0)
+	for i := range t.PieceHashes {
+		if !t.have.HasPiece(i) {
+			left += int64(t.calculatePieceSize(i))
+		}
 	}
+	return left
+}
+
+// NumPeers returns the number of peers we are connected to
+func (t *Torrent) NumPeers() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.conns)
+}
+
+// Bitfield returns a copy of the pieces we have
+func (t *Torrent) Bitfield() bitfield.Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
+	t.initHave()
+	return append(bitfield.Bitfield{}, t.have...)
+}
+
+func (t *Torrent) getPicker() *picker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	// Start workers
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	if t.picker == nil {
+		t.picker = newPicker(len(t.PieceHashes))
 	}
+	return t.picker
+}
 
-	// Collect results into a buffer until full
-	buf := make([]byte, t.Length)
-	donePieces := 0
-	for donePieces < len(t.PieceHashes) {
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
-		donePieces++
+// activePiece returns the download state of a piece, so peers working on the same piece share it
+func (t *Torrent) activePiece(index, length int) *activePiece {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-		//TODO: Add download percentage logging
+	if t.active == nil {
+		t.active = make(map[int]*activePiece)
+	}
+	ap, ok := t.active[index]
+	if !ok {
+		ap = newActivePiece(index, length)
+		t.active[index] = ap
 	}
-	close(workQueue)
+	return ap
+}
+
+func (t *Torrent) dropActivePiece(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.active, index)
+}
+
+// wantedLeft returns the number of wanted pieces not written to Storage yet. The
+// picker's own count drops as soon as a piece is verified, before it is written
+func (t *Torrent) wantedLeft(picker *picker) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	left := 0
+	for index := range t.PieceHashes {
+		if !t.have.HasPiece(index) && picker.wanted(index) {
+			left++
+		}
+	}
+	return left
+}
+
+func (t *Torrent) initHave() {
+	if t.have == nil {
+		t.have = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	}
+}
+
+func (t *Torrent) hasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.have.HasPiece(index)
+}
+
+// markHave records a verified piece and tells every connected peer about it
+func (t *Torrent) markHave(index int) {
+	t.mu.Lock()
+	t.initHave()
+	t.have.SetPiece(index)
+	t.mu.Unlock()
+
+	for _, pc := range t.connections() {
+		pc.c.SendHave(index)
+	}
+}
+
+func (t *Torrent) readBlock(index, begin int, buf []byte) error {
+	if t.Storage == nil {
+		return fmt.Errorf("no storage to serve piece %d from", index)
+	}
+	_, err := t.Storage.ReadPiece(index, begin, buf)
+	return err
+}
+
+// connections returns every peer connection of the torrent
+func (t *Torrent) connections() []*peerConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conns := make([]*peerConn, 0, len(t.conns))
+	for pc := range t.conns {
+		conns = append(conns, pc)
+	}
+	return conns
+}
+
+func (t *Torrent) stopChan() chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stop == nil {
+		t.stop = make(chan struct{})
+	}
+	return t.stop
+}
+
+func (t *Torrent) stopped() bool {
+	select {
+	case <-t.stopChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// startChoker starts deciding who we upload to. It runs until Close
+func (t *Torrent) startChoker() {
+	t.chokerOnce.Do(func() {
+		go newChoker(t).run(t.stopChan())
+	})
+}
+
+// Close stops the download, the choker and every connection. It returns once
+// nothing reads Storage any more, so Storage can be closed right after.
+// A closed torrent can't be started again
+func (t *Torrent) Close() {
+	stop := t.stopChan()
+	t.mu.Lock()
+	t.stopOnce.Do(func() {
+		close(stop)
+	})
+	t.mu.Unlock()
+
+	for _, pc := range t.connections() {
+		pc.c.Conn.Close()
+	}
+	t.workers.Wait()
+}
+
+// track counts a goroutine Close waits for. It returns false once the torrent
+// is closed, then the goroutine must not run
+func (t *Torrent) track() bool {
+	stop := t.stopChan()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Close shuts stop under t.mu, so nothing is added once it waits
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	t.workers.Add(1)
+	return true
+}
+
+// spawn runs f in a goroutine Close waits for, unless the torrent is closed
+func (t *Torrent) spawn(f func()) {
+	if !t.track() {
+		return
+	}
+	go func() {
+		defer t.workers.Done()
+		f()
+	}()
+}
+
+func (t *Torrent) addConn(c *client.Client, outgoing bool) *peerConn {
+	pc := newPeerConn(t, c, outgoing)
+	t.getPicker().addBitfield(c.Bitfield)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns == nil {
+		t.conns = make(map[*peerConn]bool)
+	}
+	t.conns[pc] = true
+
+	// Close already hung up on the others, so hang up on this one too
+	select {
+	case <-t.stop:
+		c.Conn.Close()
+	default:
+	}
+	return pc
+}
+
+func (t *Torrent) removeConn(pc *peerConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns, pc)
+	close(pc.done)
+	t.picker.removeBitfield(pc.c.Bitfield)
+}
+
+// servePeer handles a connection a peer opened to us
+func (t *Torrent) servePeer(c *client.Client) {
+	defer c.Conn.Close()
+	if !t.track() {
+		return
+	}
+	defer t.workers.Done()
+	if !t.ConnLimit.acquire() {
+		return
+	}
+	defer t.ConnLimit.release()
+
+	err := c.SendBitfield(t.Bitfield())
+	if err != nil {
+		return
+	}
+
+	pc := t.addConn(c, false)
+	defer t.removeConn(pc)
+	t.spawn(pc.uploadLoop)
+	if !t.Private {
+		go pc.pexLoop()
+	}
+
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		msg, err := c.Read()
+		if err != nil {
+			return
+		}
+		if msg == nil { // keep-alive
+			continue
+		}
+		err = pc.handleMessage(msg)
+		if err != nil {
+			log.Printf("Dropping %s: %v\n", c.Peer(), err)
+			return
+		}
+	}
+}
+
+// Seed serves pieces read from Storage to peers that connect to us until we have
+// uploaded ratio times the torrent's length or limit has passed, whichever comes first
+func (t *Torrent) Seed(ratio float64, limit time.Duration) {
+	t.startChoker()
+
+	t.mu.Lock()
+	t.initHave()
+	for i := range t.PieceHashes {
+		t.have.SetPiece(i)
+	}
+	t.mu.Unlock()
+
+	target := int64(ratio * float64(t.Length))
+	deadline := time.After(limit)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for t.Uploaded() < target {
+		select {
+		case <-deadline:
+			return
+		case <-t.stopChan():
+			return
+		case <-ticker.C:
+		}
+	}
+}
 
-	return buf, nil
+// Serve uploads pieces we have to peers that connect to us until Close
+func (t *Torrent) Serve() {
+	t.startChoker()
+	<-t.stopChan()
 }
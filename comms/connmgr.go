@@ -0,0 +1,142 @@
+package comms
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// MaxConns is the most peers a torrent downloads from at once
+var MaxConns = 50
+
+// DialInterval is the least time between two connection attempts, so a burst of
+// peers from PEX or a tracker doesn't turn into a burst of connections
+var DialInterval = 200 * time.Millisecond
+
+// MaxQueuedPeers is the most peers waiting to be connected to. Extra ones are dropped
+const MaxQueuedPeers = 1000
+
+// connManager decides when to connect to the peers we learn about. Peers come
+// from the tracker, the DHT and PEX, each one is tried once
+type connManager struct {
+	mu      sync.Mutex
+	known   map[string]bool //every peer we queued, by address
+	queue   []peers.Peer
+	running int //download workers, including ones still connecting
+
+	wake chan struct{}
+}
+
+func newConnManager() *connManager {
+	return &connManager{
+		known: make(map[string]bool),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// add queues the peers we haven't seen before
+func (cm *connManager) add(ps []peers.Peer) int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	added := 0
+	for _, p := range ps {
+		addr := p.String()
+		if cm.known[addr] || p.Port == 0 || len(cm.queue) >= MaxQueuedPeers {
+			continue
+		}
+		cm.known[addr] = true
+		cm.queue = append(cm.queue, p)
+		added++
+	}
+	if added > 0 {
+		cm.signal()
+	}
+	return added
+}
+
+func (cm *connManager) signal() {
+	select {
+	case cm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next peer to connect to if we are below MaxConns and the shared limit
+func (cm *connManager) next(limit *ConnLimit) (peers.Peer, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if len(cm.queue) == 0 || cm.running >= MaxConns || !limit.acquire() {
+		return peers.Peer{}, false
+	}
+	p := cm.queue[0]
+	cm.queue = cm.queue[1:]
+	cm.running++
+	return p, true
+}
+
+// done frees the slot of a worker that exited
+func (cm *connManager) done() {
+	cm.mu.Lock()
+	cm.running--
+	cm.mu.Unlock()
+
+	cm.signal()
+}
+
+// AddPeers hands peers to the torrent, e.g. from a tracker or PEX. New ones are
+// connected to while the download runs
+func (t *Torrent) AddPeers(ps []peers.Peer) {
+	if t.stopped() {
+		return // nothing dials them any more
+	}
+	t.getConnManager().add(ps)
+}
+
+func (t *Torrent) getConnManager() *connManager {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.connMgr == nil {
+		t.connMgr = newConnManager()
+	}
+	return t.connMgr
+}
+
+// dialLoop starts a download worker for each queued peer, at most one every
+// DialInterval, until every wanted piece is in
+func (t *Torrent) dialLoop(results chan *pieceResult) {
+	cm := t.getConnManager()
+	picker := t.getPicker()
+	stop := t.stopChan()
+
+	ticker := time.NewTicker(DialInterval)
+	defer ticker.Stop()
+
+	for picker.remaining() > 0 {
+		p, ok := cm.next(t.ConnLimit)
+		if ok {
+			go func() {
+				defer cm.done()
+				defer t.ConnLimit.release()
+				t.startDownloadWorker(p, results)
+			}()
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-cm.wake:
+		case <-time.After(time.Second): // check whether the download finished
+		case <-stop:
+			return
+		}
+	}
+}
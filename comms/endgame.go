@@ -0,0 +1,144 @@
+package comms
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/Richd0tcom/bookish-chainsaw/message"
+)
+
+// activePiece is a piece being downloaded. Normally a single peer fills it, but
+// in endgame mode every peer that has the piece asks for its missing blocks and
+// whoever delivers a block first wins. The others are sent a CANCEL for it
+type activePiece struct {
+	index int
+
+	mu         sync.Mutex
+	buf        []byte
+	got        []bool
+	missing    int
+	requesters []map[*peerConn]bool //per block, the peers we asked for it
+	claimed    bool
+
+	//closed once every block is in
+	finished chan struct{}
+}
+
+func newActivePiece(index, length int) *activePiece {
+	blocks := (length + MaxBlockSize - 1) / MaxBlockSize
+	ap := &activePiece{
+		index:      index,
+		buf:        make([]byte, length),
+		got:        make([]bool, blocks),
+		missing:    blocks,
+		requesters: make([]map[*peerConn]bool, blocks),
+		finished:   make(chan struct{}),
+	}
+	for i := range ap.requesters {
+		ap.requesters[i] = make(map[*peerConn]bool)
+	}
+	return ap
+}
+
+func (ap *activePiece) blockSize(block int) int {
+	begin := block * MaxBlockSize
+	return min(MaxBlockSize, len(ap.buf)-begin)
+}
+
+// nextBlock returns a block we don't have yet and haven't asked pc for, and
+// records that pc was asked
+func (ap *activePiece) nextBlock(pc *peerConn) (begin, length int, ok bool) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	for block, got := range ap.got {
+		if got || ap.requesters[block][pc] {
+			continue
+		}
+		ap.requesters[block][pc] = true
+		return block * MaxBlockSize, ap.blockSize(block), true
+	}
+	return 0, 0, false
+}
+
+// has reports whether the block starting at begin is in
+func (ap *activePiece) has(begin int) bool {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	return ap.got[begin/MaxBlockSize]
+}
+
+// receive stores a block from a PIECE message sent by pc. It returns the
+// block's offset, the size of the data, and the other peers that were asked
+// for the block and should be sent a CANCEL
+func (ap *activePiece) receive(pc *peerConn, msg *message.Message) (begin, n int, others []*peerConn, err error) {
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("payload too short. %d < 8", len(msg.Payload))
+	}
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	if begin%MaxBlockSize != 0 || begin >= len(ap.buf) {
+		return 0, 0, nil, fmt.Errorf("unexpected block offset %d for piece %d", begin, ap.index)
+	}
+	block := begin / MaxBlockSize
+
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	delete(ap.requesters[block], pc)
+	if ap.got[block] {
+		return begin, len(msg.Payload) - 8, nil, nil // someone beat them to it
+	}
+
+	n, err = message.ParsePiece(ap.index, ap.buf, msg)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if n != ap.blockSize(block) {
+		return 0, 0, nil, fmt.Errorf("expected block of length %d, got %d", ap.blockSize(block), n)
+	}
+
+	ap.got[block] = true
+	ap.missing--
+	for other := range ap.requesters[block] {
+		others = append(others, other)
+	}
+	ap.requesters[block] = make(map[*peerConn]bool)
+
+	if ap.missing == 0 {
+		close(ap.finished)
+	}
+	return begin, n, others, nil
+}
+
+// leave forgets the outstanding requests of a peer that gave up on the piece
+func (ap *activePiece) leave(pc *peerConn) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	for _, requesters := range ap.requesters {
+		delete(requesters, pc)
+	}
+}
+
+func (ap *activePiece) isFinished() bool {
+	select {
+	case <-ap.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+// claim hands the finished piece to the first caller. Everyone else gets false
+func (ap *activePiece) claim() ([]byte, bool) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	if ap.missing > 0 || ap.claimed {
+		return nil, false
+	}
+	ap.claimed = true
+	return ap.buf, true
+}
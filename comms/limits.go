@@ -0,0 +1,133 @@
+package comms
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter caps the bytes per second of every torrent that shares it. A
+// nil RateLimiter doesn't limit anything
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   int64   //bytes per second, 0 means unlimited
+	tokens float64 //bytes we may send right now. Negative when callers are waiting
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSecond. 0 means unlimited
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{rate: bytesPerSecond, last: time.Now()}
+}
+
+// SetRate changes the limit. 0 means unlimited
+func (l *RateLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = bytesPerSecond
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// Rate returns the limit in bytes per second, 0 if there is none
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate
+}
+
+// Wait blocks until n more bytes fit in the limit. Up to a second's worth of
+// bytes may go out in a burst
+func (l *RateLimiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens = min(float64(l.rate), l.tokens+now.Sub(l.last).Seconds()*float64(l.rate))
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// ConnLimit caps the number of peer connections of every torrent that shares
+// it. A nil ConnLimit doesn't limit anything
+type ConnLimit struct {
+	mu   sync.Mutex
+	max  int //0 means unlimited
+	open int
+}
+
+// NewConnLimit returns a limit of max connections. 0 means unlimited
+func NewConnLimit(max int) *ConnLimit {
+	return &ConnLimit{max: max}
+}
+
+// SetMax changes the limit. Connections over a lowered limit are kept until they close
+func (l *ConnLimit) SetMax(max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.max = max
+}
+
+// Max returns the limit, 0 if there is none
+func (l *ConnLimit) Max() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.max
+}
+
+// Open returns the number of connections counted against the limit
+func (l *ConnLimit) Open() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.open
+}
+
+// acquire takes a slot if one is free
+func (l *ConnLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.open >= l.max {
+		return false
+	}
+	l.open++
+	return true
+}
+
+func (l *ConnLimit) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.open--
+}
@@ -0,0 +1,294 @@
+package comms
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bitfield"
+	"github.com/Richd0tcom/bookish-chainsaw/client"
+	"github.com/Richd0tcom/bookish-chainsaw/message"
+)
+
+// MaxRequestLength is the largest block we serve. Peers asking for more are dropped
+const MaxRequestLength = 128 * 1024
+
+// MaxUploadQueue is the number of requests we queue for a peer before dropping new ones
+const MaxUploadQueue = 256
+
+// peers that stay silent for this long are dropped
+const idleTimeout = 3 * time.Minute
+
+// we send a keep-alive when we have had nothing to say for this long
+const keepAliveInterval = 90 * time.Second
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// peerConn tracks the upload side of a connection. Both the connections we open
+// to download and the ones peers open to us go through it
+type peerConn struct {
+	t *Torrent
+	c *client.Client
+
+	outgoing bool //we connected to them, so their address is one others can connect to
+
+	mu         sync.Mutex
+	amChoking  bool
+	interested bool //the peer wants pieces from us
+	requests   []blockRequest
+
+	wake chan struct{}
+	done chan struct{}
+
+	//messages from the peer, read by readLoop. Closed with readErr set when the connection fails
+	msgs    chan *message.Message
+	readErr error
+
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+
+	lastPEX time.Time //when the peer last sent us PEX
+}
+
+func newPeerConn(t *Torrent, c *client.Client, outgoing bool) *peerConn {
+	return &peerConn{
+		t:         t,
+		c:         c,
+		outgoing:  outgoing,
+		amChoking: true,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		msgs:      make(chan *message.Message, 16),
+	}
+}
+
+// handleMessage deals with every message that isn't a PIECE for a block we asked for
+func (pc *peerConn) handleMessage(msg *message.Message) error {
+	switch msg.ID {
+	case message.MSG_UNCHOKE:
+		pc.c.Choked = false
+	case message.MSG_CHOKE:
+		pc.c.Choked = true
+	case message.MSG_HAVE:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if index < 0 || index >= len(pc.t.PieceHashes) {
+			return fmt.Errorf("peer has piece %d out of range", index)
+		}
+		pc.ensureBitfield()
+		if !pc.c.Bitfield.HasPiece(index) {
+			pc.c.Bitfield.SetPiece(index)
+			pc.t.getPicker().addHave(index)
+		}
+	case message.MSG_BITFIELD:
+		picker := pc.t.getPicker()
+		picker.removeBitfield(pc.c.Bitfield)
+		pc.c.Bitfield = bitfield.Bitfield(msg.Payload)
+		pc.ensureBitfield()
+		picker.addBitfield(pc.c.Bitfield)
+	case message.MSG_INTERESTED:
+		// the choker decides whether to unchoke them
+		pc.mu.Lock()
+		pc.interested = true
+		pc.mu.Unlock()
+	case message.MSG_NOT_INTERESTED:
+		pc.mu.Lock()
+		pc.interested = false
+		pc.mu.Unlock()
+	case message.MSG_REQUEST:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		return pc.queueRequest(blockRequest{index, begin, length})
+	case message.MSG_CANCEL:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		pc.cancelRequest(blockRequest{index, begin, length})
+	case message.MSG_EXTENDED:
+		return pc.handleExtended(msg)
+	}
+	return nil
+}
+
+// peers that never sent a bitfield have nothing yet, give them an empty one
+func (pc *peerConn) ensureBitfield() {
+	size := (len(pc.t.PieceHashes) + 7) / 8
+	if len(pc.c.Bitfield) < size {
+		bf := make(bitfield.Bitfield, size)
+		copy(bf, pc.c.Bitfield)
+		pc.c.Bitfield = bf
+	}
+}
+
+// readLoop reads messages from a connection we download from and hands them to
+// the download worker through msgs, so the worker can stop waiting on a peer
+// when another one delivers the blocks it asked for
+func (pc *peerConn) readLoop() {
+	defer close(pc.msgs)
+
+	for {
+		pc.c.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		msg, err := pc.c.Read()
+		if err != nil {
+			pc.readErr = err
+			return
+		}
+
+		select {
+		case pc.msgs <- msg:
+		case <-pc.done:
+			return
+		}
+	}
+}
+
+// waitForPieces handles messages from a peer that has nothing we need for a
+// while, so its HAVEs keep coming in
+func (pc *peerConn) waitForPieces() error {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg, ok := <-pc.msgs:
+			if !ok {
+				return pc.readErr
+			}
+			if msg == nil || msg.ID == message.MSG_PIECE { // keep-alive or a block we no longer want
+				continue
+			}
+			err := pc.handleMessage(msg)
+			if err != nil {
+				return err
+			}
+			if msg.ID == message.MSG_HAVE || msg.ID == message.MSG_BITFIELD {
+				return nil
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+func (pc *peerConn) isInterested() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.interested
+}
+
+func (pc *peerConn) setChoking(choke bool) error {
+	pc.mu.Lock()
+	if pc.amChoking == choke {
+		pc.mu.Unlock()
+		return nil
+	}
+	pc.amChoking = choke
+	if choke {
+		// choking a peer throws away everything it asked for
+		pc.requests = nil
+	}
+	pc.mu.Unlock()
+
+	if choke {
+		return pc.c.Choke()
+	}
+	return pc.c.Unchoke()
+}
+
+func (pc *peerConn) queueRequest(req blockRequest) error {
+	if req.length <= 0 || req.length > MaxRequestLength {
+		return fmt.Errorf("peer requested block of length %d", req.length)
+	}
+	if req.index < 0 || req.index >= len(pc.t.PieceHashes) {
+		return fmt.Errorf("peer requested piece %d out of range", req.index)
+	}
+	if req.begin < 0 || req.begin+req.length > pc.t.calculatePieceSize(req.index) {
+		return fmt.Errorf("peer requested block %d+%d past the end of piece %d", req.begin, req.length, req.index)
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	// requests from choked peers are ignored
+	if pc.amChoking || len(pc.requests) >= MaxUploadQueue || !pc.t.hasPiece(req.index) {
+		return nil
+	}
+	pc.requests = append(pc.requests, req)
+
+	select {
+	case pc.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (pc *peerConn) cancelRequest(req blockRequest) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	for i, queued := range pc.requests {
+		if queued == req {
+			pc.requests = append(pc.requests[:i], pc.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+func (pc *peerConn) nextRequest() (blockRequest, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if len(pc.requests) == 0 {
+		return blockRequest{}, false
+	}
+	req := pc.requests[0]
+	pc.requests = pc.requests[1:]
+	return req, true
+}
+
+// uploadLoop serves queued requests until the connection goes away
+func (pc *peerConn) uploadLoop() {
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-pc.done:
+			return
+		case <-keepAlive.C:
+			pc.c.KeepAlive()
+			continue
+		case <-pc.wake:
+		}
+
+		for {
+			req, ok := pc.nextRequest()
+			if !ok {
+				break
+			}
+
+			pc.t.UploadLimit.Wait(req.length)
+			buf := make([]byte, req.length)
+			err := pc.t.readBlock(req.index, req.begin, buf)
+			if err != nil {
+				pc.c.Conn.Close()
+				return
+			}
+			err = pc.c.SendPiece(req.index, req.begin, buf)
+			if err != nil {
+				return
+			}
+			pc.uploaded.Add(int64(req.length))
+			pc.t.uploaded.Add(int64(req.length))
+		}
+	}
+}
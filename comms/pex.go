@@ -0,0 +1,145 @@
+package comms
+
+import (
+	"log"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/extension"
+	"github.com/Richd0tcom/bookish-chainsaw/message"
+	"github.com/Richd0tcom/bookish-chainsaw/metadata"
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+	"github.com/Richd0tcom/bookish-chainsaw/pex"
+)
+
+// PEXInterval is how often we tell peers about the peers we are connected to.
+// Peers that send us PEX more often than this are ignored until it passes
+var PEXInterval = time.Minute
+
+// handleExtended deals with extended messages. The extension handshake is
+// already taken care of by the client
+func (pc *peerConn) handleExtended(msg *message.Message) error {
+	extID, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+	name, ok := extension.LocalName(extID)
+	if !ok {
+		return nil
+	}
+	if name == extension.UTMetadata {
+		return pc.handleMetadata(payload)
+	}
+	if name != extension.UTPex || pc.t.Private {
+		return nil
+	}
+
+	// don't let a chatty peer flood the connection manager
+	if time.Since(pc.lastPEX) < PEXInterval/2 {
+		return nil
+	}
+	pc.lastPEX = time.Now()
+
+	m, err := pex.Parse(payload)
+	if err != nil {
+		return err
+	}
+	added := m.Added
+	if len(added) > pex.MaxPeers {
+		added = added[:pex.MaxPeers]
+	}
+	pc.t.AddPeers(added)
+	return nil
+}
+
+// handleMetadata answers a peer fetching the info dictionary from us, with a
+// reject if we don't have it
+func (pc *peerConn) handleMetadata(payload []byte) error {
+	reply, err := metadata.Reply(pc.t.RawInfo, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+	return pc.c.SendExtended(extension.UTMetadata, reply)
+}
+
+// pexAddr returns the address other peers can reach pc's peer on. For peers
+// that connected to us that is the listen port from their extension handshake
+func (pc *peerConn) pexAddr() (peers.Peer, bool) {
+	if pc.outgoing {
+		return pc.c.Peer(), true
+	}
+	ext := pc.c.ExtensionHandshake()
+	if ext == nil || ext.P <= 0 || ext.P > 65535 {
+		return peers.Peer{}, false
+	}
+	return peers.Peer{IP: pc.c.Peer().IP, Port: uint16(ext.P)}, true
+}
+
+// pexLoop tells the peer which peers we connected to and dropped every PEXInterval
+func (pc *peerConn) pexLoop() {
+	ticker := time.NewTicker(PEXInterval)
+	defer ticker.Stop()
+
+	//the peers the other side knows about from us, by address
+	sent := make(map[string]peers.Peer)
+	for {
+		select {
+		case <-pc.done:
+			return
+		case <-ticker.C:
+		}
+
+		if !pc.c.SupportsExtension(extension.UTPex) {
+			continue
+		}
+		m := pc.nextPEX(sent)
+		if len(m.Added) == 0 && len(m.Dropped) == 0 {
+			continue
+		}
+
+		payload, err := m.Serialize()
+		if err != nil {
+			log.Println("Could not encode PEX message:", err)
+			return
+		}
+		err = pc.c.SendExtended(extension.UTPex, payload)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// nextPEX works out what changed since the last message and updates sent to match
+func (pc *peerConn) nextPEX(sent map[string]peers.Peer) *pex.Message {
+	current := make(map[string]*peerConn)
+	for _, other := range pc.t.connections() {
+		if other == pc {
+			continue
+		}
+		if p, ok := other.pexAddr(); ok {
+			current[p.String()] = other
+		}
+	}
+
+	m := &pex.Message{}
+	for addr, other := range current {
+		if _, ok := sent[addr]; ok || len(m.Added) >= pex.MaxPeers {
+			continue
+		}
+		p, _ := other.pexAddr()
+		var flags byte
+		if other.outgoing {
+			flags |= pex.FlagReachable
+		}
+		m.Added = append(m.Added, p)
+		m.Flags = append(m.Flags, flags)
+		sent[addr] = p
+	}
+	for addr, p := range sent {
+		if _, ok := current[addr]; ok || len(m.Dropped) >= pex.MaxPeers {
+			continue
+		}
+		m.Dropped = append(m.Dropped, p)
+		delete(sent, addr)
+	}
+	return m
+}
@@ -0,0 +1,251 @@
+package comms
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bitfield"
+)
+
+// piece priorities. Pieces with a higher priority are always picked first
+const (
+	PriorityNone   = 0 //don't download
+	PriorityNormal = 1
+	PriorityHigh   = 2
+)
+
+// RandomFirstPieces is the number of pieces picked at random before switching
+// to rarest first. Common pieces finish quickly, which gives us something to trade
+const RandomFirstPieces = 4
+
+type pieceState int
+
+const (
+	pieceMissing pieceState = iota
+	pieceInFlight
+	pieceDone
+)
+
+// picker decides which piece each peer should send us next. It tracks how many
+// connected peers have each piece and picks the rarest one the peer has
+type picker struct {
+	mu           sync.Mutex
+	availability []int
+	state        []pieceState
+	priority     []int
+	downloaders  []int //peers working on each in-flight piece
+	done         int
+	endgame      bool
+
+	//gets a value when a priority changes, so Download notices it has less or more to wait for
+	changed chan struct{}
+}
+
+func newPicker(numPieces int) *picker {
+	p := &picker{
+		availability: make([]int, numPieces),
+		state:        make([]pieceState, numPieces),
+		priority:     make([]int, numPieces),
+		downloaders:  make([]int, numPieces),
+		changed:      make(chan struct{}, 1),
+	}
+	for i := range p.priority {
+		p.priority[i] = PriorityNormal
+	}
+	return p
+}
+
+// addBitfield counts the pieces of a peer that just connected
+func (p *picker) addBitfield(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// removeBitfield forgets the pieces of a peer that went away
+func (p *picker) removeBitfield(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if bf.HasPiece(i) && p.availability[i] > 0 {
+			p.availability[i]--
+		}
+	}
+}
+
+// addHave counts a piece a peer announced with HAVE
+func (p *picker) addHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+func (p *picker) setPriority(index, priority int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.priority[index] = priority
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// wanted reports whether a piece is to be downloaded at all
+func (p *picker) wanted(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.priority[index] != PriorityNone
+}
+
+// pick returns the next piece to request from a peer with bitfield bf and marks
+// it in flight. It returns -1 if the peer has nothing we still need. Once every
+// wanted piece is in flight we are in endgame mode and hand out pieces other
+// peers are already working on
+func (p *picker) pick(bf bitfield.Bitfield) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.endgame && p.allInFlight() {
+		p.endgame = true
+		log.Println("Entering endgame mode")
+	}
+	if p.endgame {
+		return p.pickEndgame(bf)
+	}
+
+	randomFirst := p.done < RandomFirstPieces
+
+	best := -1
+	ties := 0
+	for i, state := range p.state {
+		if state != pieceMissing || p.priority[i] == PriorityNone || !bf.HasPiece(i) {
+			continue
+		}
+
+		cmp := 1
+		if best != -1 {
+			cmp = p.compare(i, best, randomFirst)
+		}
+		switch {
+		case cmp > 0:
+			best = i
+			ties = 1
+		case cmp == 0:
+			// pick uniformly among equally good pieces so peers don't all go for the same one
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+
+	if best != -1 {
+		p.state[best] = pieceInFlight
+		p.downloaders[best]++
+	}
+	return best
+}
+
+// allInFlight reports whether no wanted piece is waiting to be requested
+func (p *picker) allInFlight() bool {
+	for i, state := range p.state {
+		if state == pieceMissing && p.priority[i] != PriorityNone {
+			return false
+		}
+	}
+	return true
+}
+
+// pickEndgame returns the unfinished piece the peer has with the fewest peers on it
+func (p *picker) pickEndgame(bf bitfield.Bitfield) int {
+	best := -1
+	for i, state := range p.state {
+		if state == pieceDone || p.priority[i] == PriorityNone || !bf.HasPiece(i) {
+			continue
+		}
+		if best == -1 || p.downloaders[i] < p.downloaders[best] {
+			best = i
+		}
+	}
+
+	if best != -1 {
+		p.state[best] = pieceInFlight
+		p.downloaders[best]++
+	}
+	return best
+}
+
+// compare returns a positive number if piece a should be picked over piece b,
+// 0 if they are equally good and a negative number otherwise
+func (p *picker) compare(a, b int, randomFirst bool) int {
+	if p.priority[a] != p.priority[b] {
+		return p.priority[a] - p.priority[b]
+	}
+	if randomFirst {
+		return 0
+	}
+	return p.availability[b] - p.availability[a]
+}
+
+// abort is called by a peer that gave up on a piece. Once nobody is working
+// on it the piece is back up for grabs
+func (p *picker) abort(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.downloaders[index] > 0 {
+		p.downloaders[index]--
+	}
+	if p.state[index] == pieceInFlight && p.downloaders[index] == 0 {
+		p.state[index] = pieceMissing
+	}
+}
+
+// reset puts a piece that failed its integrity check back up for grabs
+func (p *picker) reset(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state[index] != pieceDone {
+		p.state[index] = pieceMissing
+		p.downloaders[index] = 0
+	}
+}
+
+// finish marks a piece as downloaded and verified
+func (p *picker) finish(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state[index] != pieceDone {
+		p.state[index] = pieceDone
+		p.downloaders[index] = 0
+		p.done++
+	}
+}
+
+// remaining returns the number of wanted pieces we don't have yet
+func (p *picker) remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	count := 0
+	for i, state := range p.state {
+		if state != pieceDone && p.priority[i] != PriorityNone {
+			count++
+		}
+	}
+	return count
+}
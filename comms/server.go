@@ -0,0 +1,104 @@
+package comms
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/Richd0tcom/bookish-chainsaw/client"
+)
+
+// Server accepts connections from peers and hands them to the torrent they ask for
+type Server struct {
+	ln   net.Listener
+	port uint16
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+}
+
+// Listen starts accepting peer connections on port
+func Listen(port uint16) (*Server, error) {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ln:       ln,
+		port:     port,
+		torrents: make(map[[20]byte]*Torrent),
+	}
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Add starts serving a torrent to peers that connect to us
+func (s *Server) Add(t *Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.torrents[t.InfoHash] = t
+}
+
+// Remove stops accepting connections for a torrent
+func (s *Server) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.torrents, infoHash)
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Close stops accepting connections
+func (s *Server) Close() error {
+	return s.ln.Close()
+}
+
+func (s *Server) lookup(infoHash [20]byte) ([20]byte, int, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return [20]byte{}, 0, false, false
+	}
+	return t.PeerID, len(t.RawInfo), t.Private, true
+}
+
+func (s *Server) acceptLoop() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("Accept failed:", err)
+			continue
+		}
+
+		go func() {
+			c, err := client.Accept(conn, s.port, s.lookup)
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			t, ok := s.torrents[c.InfoHash()]
+			s.mu.Unlock()
+			if !ok {
+				c.Conn.Close()
+				return
+			}
+
+			log.Printf("Accepted connection from %s\n", c.Peer())
+			t.servePeer(c)
+		}()
+	}
+}
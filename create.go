@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/extension"
+	"github.com/Richd0tcom/bookish-chainsaw/torrentfile"
+)
+
+// listFlag collects every use of a repeatable flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runCreate makes a .torrent of a file or directory
+func runCreate(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	output := fs.String("o", "", "where to write the torrent (default <name>.torrent)")
+	name := fs.String("name", "", "name of the torrent (default the base name of the content)")
+	pieceLength := fs.Int("piece-length", 0, "bytes per piece (default picked from the content's size)")
+	comment := fs.String("comment", "", "comment stored in the torrent")
+	createdBy := fs.String("created-by", extension.ClientVersion, "program stored as the torrent's creator")
+	noDate := fs.Bool("no-date", false, "leave out the creation date")
+	private := fs.Bool("private", false, "only get peers from the trackers")
+	var trackers, webSeeds listFlag
+	fs.Var(&trackers, "tracker", "tracker announce URL, repeat for more tiers. Separate backup trackers of a tier with commas")
+	fs.Var(&webSeeds, "web-seed", "URL of an HTTP server holding the content, may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s create [flags] <file or directory>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	content := fs.Arg(0)
+
+	opts := torrentfile.CreateOptions{
+		Name:        *name,
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		WebSeeds:    webSeeds,
+	}
+	for _, tier := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+
+	data, err := torrentfile.Create(content, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", content, err)
+		os.Exit(1)
+	}
+
+	out := *output
+	if out == "" {
+		base := *name
+		if base == "" {
+			abs, err := filepath.Abs(content)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			base = filepath.Base(abs)
+		}
+		out = base + ".torrent"
+	}
+	err = os.WriteFile(out, data, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// read it back so what we print is what a client will see
+	tf, err := torrentfile.OpenFile(out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", out, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %d bytes in %d pieces of %d, infohash %x\n", out, tf.Length, len(tf.PieceHashes), tf.PieceLength, tf.InfoHash)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Richd0tcom/bookish-chainsaw/daemon"
+	"github.com/Richd0tcom/bookish-chainsaw/torrentfile"
+)
+
+// runDaemon runs torrents in the background until it is killed, controlled over JSON-RPC
+func runDaemon(args []string) {
+	home, _ := os.UserHomeDir()
+
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:9091", "loopback address to serve the API on")
+	socket := fs.String("socket", "", "serve the API on this Unix socket instead of -listen")
+	stateDir := fs.String("state", filepath.Join(home, ".bookish-chainsaw"), "directory to keep the torrent list in")
+	dir := fs.String("dir", ".", "directory to download into")
+	port := fs.Uint("port", uint(torrentfile.Port), "TCP port peers connect to")
+	dhtAddr := fs.String("dht", ":6881", "UDP address of the DHT node, empty disables the DHT")
+	token := fs.String("token", "", "token clients must send, default is read from or generated into <state>/token")
+	downRate := fs.Int64("down-rate", 0, "download limit in bytes per second (0 is unlimited)")
+	upRate := fs.Int64("up-rate", 0, "upload limit in bytes per second (0 is unlimited)")
+	maxConns := fs.Int("max-conns", 0, "peer connections across all torrents (0 is unlimited)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s daemon [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *port == 0 || *port > 65535 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	err := os.MkdirAll(*stateDir, 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *token == "" {
+		*token, err = loadToken(filepath.Join(*stateDir, "token"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	downloadDir, err := filepath.Abs(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var l net.Listener
+	if *socket != "" {
+		l, err = listenUnix(*socket)
+	} else {
+		l, err = listenLoopback(*listen)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	d, err := daemon.New(daemon.Config{
+		StateDir:    *stateDir,
+		DownloadDir: downloadDir,
+		Token:       *token,
+		Session: torrentfile.SessionConfig{
+			Port:         uint16(*port),
+			DHTAddr:      *dhtAddr,
+			DownloadRate: *downRate,
+			UploadRate:   *upRate,
+			MaxConns:     *maxConns,
+		},
+	})
+	if err != nil {
+		l.Close()
+		log.Fatal(err)
+	}
+
+	server := &http.Server{Handler: d}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+		server.Close()
+	}()
+
+	log.Printf("Serving API on %s, peers connect on port %d\n", l.Addr(), d.Session().Port())
+	err = server.Serve(l)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println(err)
+	}
+	err = d.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listenLoopback refuses addresses other machines could reach, the token is sent in the clear
+func listenLoopback(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%s is not a loopback address, use -socket to serve elsewhere", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on a socket only our user can connect to. A socket left
+// behind by a daemon that died is replaced
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// loadToken reads the token at path, making a random one the first time
+func loadToken(path string) (string, error) {
+	buf, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(buf)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	err = os.WriteFile(path, []byte(token+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Wrote new API token to %s\n", path)
+	return token, nil
+}
@@ -0,0 +1,106 @@
+// Package daemon runs a Session as a long-lived service controlled over HTTP
+// with JSON-RPC 2.0. Every request needs the daemon's token in an
+// Authorization: Bearer header. The torrent list is kept in a state directory
+// so it survives restarts
+package daemon
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Richd0tcom/bookish-chainsaw/torrentfile"
+)
+
+// Config configures a Daemon
+type Config struct {
+	//where the torrent list and the .torrent of every torrent are kept
+	StateDir string
+
+	//where torrents are downloaded to unless an add says otherwise
+	DownloadDir string
+
+	//clients must send this in an Authorization: Bearer header. Must not be empty
+	Token string
+
+	Session torrentfile.SessionConfig
+}
+
+// Daemon owns a Session and serves the JSON-RPC API for it
+type Daemon struct {
+	cfg     Config
+	session *torrentfile.Session
+
+	//held while the torrent list changes, so it is saved in the order it changed
+	mu sync.Mutex
+
+	//magnets whose metadata is still being fetched, by infohash. Guarded by mu
+	fetching map[[20]byte]*pendingMagnet
+	//set by Close, magnets that finish fetching later are left for the next start
+	closed bool
+}
+
+// New starts a Session and adds the torrents saved in the state directory
+func New(cfg Config) (*Daemon, error) {
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("daemon needs a token")
+	}
+	err := os.MkdirAll(torrentsDir(cfg.StateDir), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := torrentfile.NewSession(cfg.Session)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Daemon{cfg: cfg, session: session, fetching: make(map[[20]byte]*pendingMagnet)}
+	err = d.load()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Session returns the session the daemon controls
+func (d *Daemon) Session() *torrentfile.Session {
+	return d.session
+}
+
+// Close saves the torrent list and stops every torrent
+func (d *Daemon) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	err := d.save()
+	d.mu.Unlock()
+	if err != nil {
+		log.Println("Could not save torrent list:", err)
+	}
+	return d.session.Close()
+}
+
+// ServeHTTP answers JSON-RPC requests POSTed to any path
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !d.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	d.serveRPC(w, r)
+}
+
+func (d *Daemon) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(d.cfg.Token)) == 1
+}
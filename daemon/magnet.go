@@ -0,0 +1,79 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/Richd0tcom/bookish-chainsaw/magnet"
+)
+
+// stateFetching is how magnets show up in results until their metadata arrives
+const stateFetching = "fetching"
+
+// pendingMagnet is a magnet whose metadata is still being fetched. It turns
+// into a torrent of the session once the metadata is in
+type pendingMagnet struct {
+	uri    string
+	m      magnet.Magnet
+	dir    string //absolute, the torrent goes below it
+	paused bool
+
+	//why fetching failed. The magnet stays listed until it is removed
+	err error
+}
+
+// fetchMagnet lists the magnet and fetches its metadata in the background.
+// Callers hold d.mu
+func (d *Daemon) fetchMagnet(uri string, m magnet.Magnet, dir string, paused bool) (*pendingMagnet, error) {
+	_, added := d.session.Get(m.InfoHash)
+	_, fetching := d.fetching[m.InfoHash]
+	if added || fetching {
+		return nil, fmt.Errorf("torrent %x was already added", m.InfoHash)
+	}
+
+	pm := &pendingMagnet{uri: uri, m: m, dir: dir, paused: paused}
+	d.fetching[m.InfoHash] = pm
+	go d.finishMagnet(pm)
+	return pm, nil
+}
+
+// finishMagnet fetches the metadata through the session's DHT node and adds the torrent
+func (d *Daemon) finishMagnet(pm *pendingMagnet) {
+	tf, err := d.session.FetchMagnet(pm.m)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// removed while we were fetching, or the daemon is shutting down
+	if d.closed || d.fetching[pm.m.InfoHash] != pm {
+		return
+	}
+	if err == nil {
+		_, err = d.addTorrent(tf, pm.dir, pm.paused)
+	}
+	if err != nil {
+		log.Printf("Could not add magnet %x: %v\n", pm.m.InfoHash, err)
+		pm.err = err
+		return
+	}
+	err = d.save()
+	if err != nil {
+		log.Println("Could not save torrent list:", err)
+	}
+}
+
+// status is how the magnet looks in results. Callers hold d.mu
+func (pm *pendingMagnet) status() torrentStatus {
+	status := torrentStatus{
+		InfoHash: hex.EncodeToString(pm.m.InfoHash[:]),
+		Name:     pm.m.Name,
+		Path:     pm.dir,
+		State:    stateFetching,
+	}
+	if pm.err != nil {
+		status.State = "error"
+		status.Error = pm.err.Error()
+	}
+	return status
+}
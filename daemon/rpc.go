@@ -0,0 +1,497 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/magnet"
+	"github.com/Richd0tcom/bookish-chainsaw/torrentfile"
+)
+
+// MaxTorrentSize caps .torrent files fetched from a URL or sent in a request
+var MaxTorrentSize int64 = 10 << 20
+
+// FetchTimeout is how long fetching a .torrent from a URL may take
+var FetchTimeout = 30 * time.Second
+
+// JSON-RPC 2.0 error codes
+const (
+	errParse          = -32700
+	errInvalidRequest = -32600
+	errMethodNotFound = -32601
+	errInvalidParams  = -32602
+	errFailed         = -32000 //the method ran and failed
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	//absent for notifications, which get no response
+	ID json.RawMessage `json:"id"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func invalidParams(format string, a ...any) *rpcError {
+	return &rpcError{Code: errInvalidParams, Message: fmt.Sprintf(format, a...)}
+}
+
+// the methods of the API. Each gets the request's params and returns something that encodes as its result
+var methods = map[string]func(d *Daemon, params json.RawMessage) (any, error){
+	"add":        (*Daemon).rpcAdd,
+	"list":       (*Daemon).rpcList,
+	"stats":      (*Daemon).rpcStats,
+	"pause":      (*Daemon).rpcPause,
+	"resume":     (*Daemon).rpcResume,
+	"remove":     (*Daemon).rpcRemove,
+	"set_limits": (*Daemon).rpcSetLimits,
+}
+
+func (d *Daemon) serveRPC(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 2*MaxTorrentSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp := rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null")}
+	req := rpcRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		// batches are valid JSON but not something we take
+		var batch []json.RawMessage
+		if json.Unmarshal(body, &batch) == nil {
+			resp.Error = &rpcError{Code: errInvalidRequest, Message: "batch requests are not supported"}
+		} else {
+			resp.Error = &rpcError{Code: errParse, Message: err.Error()}
+		}
+		writeResponse(w, resp)
+		return
+	}
+	if req.ID != nil {
+		resp.ID = req.ID
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		resp.Error = &rpcError{Code: errInvalidRequest, Message: `requests need "jsonrpc": "2.0" and a method`}
+		writeResponse(w, resp)
+		return
+	}
+
+	method, ok := methods[req.Method]
+	if !ok {
+		resp.Error = &rpcError{Code: errMethodNotFound, Message: fmt.Sprintf("no method %q", req.Method)}
+		writeResponse(w, resp)
+		return
+	}
+
+	result, err := method(d, req.Params)
+	if req.ID == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		var rerr *rpcError
+		if !errors.As(err, &rerr) {
+			rerr = &rpcError{Code: errFailed, Message: err.Error()}
+		}
+		resp.Error = rerr
+	} else {
+		resp.Result = result
+	}
+	writeResponse(w, resp)
+}
+
+func writeResponse(w http.ResponseWriter, resp rpcResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println("Could not write response:", err)
+	}
+}
+
+// decodeParams fills v from params. Missing params leave v alone
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(string(params)))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		return invalidParams("bad params: %v", err)
+	}
+	return nil
+}
+
+// torrentStatus is how a torrent looks in results
+type torrentStatus struct {
+	InfoHash   string  `json:"info_hash"`
+	Name       string  `json:"name"`
+	Path       string  `json:"path"`
+	State      string  `json:"state"`
+	Error      string  `json:"error,omitempty"`
+	Length     int64   `json:"length"`
+	Left       int64   `json:"left"`
+	Progress   float64 `json:"progress"` //0 to 1
+	Downloaded int64   `json:"downloaded"`
+	Uploaded   int64   `json:"uploaded"`
+	Peers      int     `json:"peers"`
+}
+
+func newTorrentStatus(t *torrentfile.Torrent) torrentStatus {
+	tf := t.File()
+	stats := t.Stats()
+	status := torrentStatus{
+		InfoHash:   hex.EncodeToString(tf.InfoHash[:]),
+		Name:       tf.Name,
+		Path:       t.Path(),
+		State:      stats.State.String(),
+		Length:     stats.Length,
+		Left:       stats.Left,
+		Downloaded: stats.Downloaded,
+		Uploaded:   stats.Uploaded,
+		Peers:      stats.Peers,
+	}
+	if stats.Err != nil {
+		status.Error = stats.Err.Error()
+	}
+	if stats.Length > 0 {
+		status.Progress = float64(stats.Length-stats.Left) / float64(stats.Length)
+	}
+	return status
+}
+
+type addParams struct {
+	//exactly one of these says where the torrent comes from
+	File   string `json:"file"`   //path of a .torrent on the daemon's machine
+	Data   []byte `json:"data"`   //a .torrent, base64 encoded
+	Magnet string `json:"magnet"` //listed as fetching until the metadata arrives
+	URL    string `json:"url"`    //http(s) URL of a .torrent
+
+	//directory to download into, defaults to the daemon's download directory
+	Dir    string `json:"dir"`
+	Paused bool   `json:"paused"`
+}
+
+func (d *Daemon) rpcAdd(params json.RawMessage) (any, error) {
+	p := addParams{}
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := 0
+	for _, set := range []bool{p.File != "", len(p.Data) > 0, p.Magnet != "", p.URL != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, invalidParams("add needs exactly one of file, data, magnet and url")
+	}
+
+	dir := p.Dir
+	if dir == "" {
+		dir = d.cfg.DownloadDir
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// fetching the metadata can take minutes, so magnets are added right away and finish later
+	if p.Magnet != "" {
+		m, err := magnet.Parse(p.Magnet)
+		if err != nil {
+			return nil, invalidParams("bad magnet: %v", err)
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		pm, err := d.fetchMagnet(p.Magnet, m, dir, p.Paused)
+		if err != nil {
+			return nil, err
+		}
+		return pm.status(), d.save()
+	}
+
+	var tf torrentfile.TorrentFile
+	switch {
+	case p.File != "":
+		tf, err = torrentfile.OpenFile(p.File)
+	case len(p.Data) > 0:
+		tf, err = torrentfile.Parse(p.Data)
+	case p.URL != "":
+		tf, err = fetchTorrent(p.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, err := d.addTorrent(tf, dir, p.Paused)
+	if err != nil {
+		return nil, err
+	}
+	return newTorrentStatus(t), d.save()
+}
+
+// addTorrent adds tf to the session below dir and keeps its .torrent. A magnet
+// still fetching the same torrent is done. Callers hold d.mu and save the list
+func (d *Daemon) addTorrent(tf torrentfile.TorrentFile, dir string, paused bool) (*torrentfile.Torrent, error) {
+	path := filepath.Join(dir, localName(tf))
+	buf, err := tf.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	// the session rejects torrents it can't run, only those are saved
+	var t *torrentfile.Torrent
+	if paused {
+		t, err = d.session.AddPaused(tf, path)
+	} else {
+		t, err = d.session.Add(tf, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the .torrent goes before the list, a torrent in the list without one can't be restored
+	err = os.WriteFile(torrentPath(d.cfg.StateDir, tf.InfoHash), buf, 0600)
+	if err != nil {
+		d.session.Remove(tf.InfoHash, false)
+		return nil, err
+	}
+	delete(d.fetching, tf.InfoHash)
+	log.Printf("Added %s into %s\n", tf.Name, path)
+	return t, nil
+}
+
+// localName is what the torrent's file or directory is called on disk. The
+// name comes from whoever made the torrent, so it must not leave the directory
+func localName(tf torrentfile.TorrentFile) string {
+	name := tf.Name
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return hex.EncodeToString(tf.InfoHash[:])
+	}
+	return name
+}
+
+func fetchTorrent(url string) (torrentfile.TorrentFile, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return torrentfile.TorrentFile{}, invalidParams("url must be http or https")
+	}
+	client := http.Client{Timeout: FetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return torrentfile.TorrentFile{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return torrentfile.TorrentFile{}, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxTorrentSize+1))
+	if err != nil {
+		return torrentfile.TorrentFile{}, err
+	}
+	if int64(len(data)) > MaxTorrentSize {
+		return torrentfile.TorrentFile{}, fmt.Errorf("%s is larger than %d bytes", url, MaxTorrentSize)
+	}
+	return torrentfile.Parse(data)
+}
+
+func (d *Daemon) rpcList(params json.RawMessage) (any, error) {
+	list := []torrentStatus{}
+	for _, t := range d.session.Torrents() {
+		list = append(list, newTorrentStatus(t))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, pm := range d.fetching {
+		list = append(list, pm.status())
+	}
+	return list, nil
+}
+
+type sessionStatus struct {
+	Port         uint16 `json:"port"`
+	Torrents     int    `json:"torrents"`
+	Conns        int    `json:"conns"`
+	DownloadRate int64  `json:"download_rate"`
+	UploadRate   int64  `json:"upload_rate"`
+	MaxConns     int    `json:"max_conns"`
+	Downloaded   int64  `json:"downloaded"`
+	Uploaded     int64  `json:"uploaded"`
+}
+
+func (d *Daemon) rpcStats(params json.RawMessage) (any, error) {
+	stats := d.session.Stats()
+	return sessionStatus{
+		Port:         d.session.Port(),
+		Torrents:     stats.Torrents,
+		Conns:        stats.Conns,
+		DownloadRate: stats.DownloadRate,
+		UploadRate:   stats.UploadRate,
+		MaxConns:     stats.MaxConns,
+		Downloaded:   stats.Downloaded,
+		Uploaded:     stats.Uploaded,
+	}, nil
+}
+
+type torrentParams struct {
+	InfoHash   string `json:"info_hash"`   //hex
+	DeleteData bool   `json:"delete_data"` //remove only
+}
+
+func (p torrentParams) infoHash() ([20]byte, error) {
+	var ih [20]byte
+	b, err := hex.DecodeString(p.InfoHash)
+	if err != nil || len(b) != len(ih) {
+		return ih, invalidParams("info_hash must be 40 hex digits")
+	}
+	copy(ih[:], b)
+	return ih, nil
+}
+
+// torrent finds the torrent named by params
+func (d *Daemon) torrent(params json.RawMessage) (*torrentfile.Torrent, error) {
+	p := torrentParams{}
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	ih, err := p.infoHash()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := d.session.Get(ih)
+	if !ok {
+		d.mu.Lock()
+		_, fetching := d.fetching[ih]
+		d.mu.Unlock()
+		if fetching {
+			return nil, fmt.Errorf("torrent %x is still fetching metadata", ih)
+		}
+		return nil, fmt.Errorf("no torrent %x", ih)
+	}
+	return t, nil
+}
+
+func (d *Daemon) rpcPause(params json.RawMessage) (any, error) {
+	t, err := d.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+	t.Pause()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return newTorrentStatus(t), d.save()
+}
+
+func (d *Daemon) rpcResume(params json.RawMessage) (any, error) {
+	t, err := d.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+	t.Resume()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return newTorrentStatus(t), d.save()
+}
+
+func (d *Daemon) rpcRemove(params json.RawMessage) (any, error) {
+	p := torrentParams{}
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	ih, err := p.infoHash()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// nothing was downloaded yet, so there is no data to delete either
+	if _, ok := d.fetching[ih]; ok {
+		delete(d.fetching, ih)
+		return true, d.save()
+	}
+
+	err = d.session.Remove(ih, p.DeleteData)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Remove(torrentPath(d.cfg.StateDir, ih))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("Could not remove saved torrent:", err)
+	}
+	return true, d.save()
+}
+
+type limitParams struct {
+	//bytes per second and connections, 0 means unlimited. Limits left out stay as they are
+	DownloadRate *int64 `json:"download_rate"`
+	UploadRate   *int64 `json:"upload_rate"`
+	MaxConns     *int   `json:"max_conns"`
+}
+
+func (d *Daemon) rpcSetLimits(params json.RawMessage) (any, error) {
+	p := limitParams{}
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range []*int64{p.DownloadRate, p.UploadRate} {
+		if v != nil && *v < 0 {
+			return nil, invalidParams("rates can't be negative")
+		}
+	}
+	if p.MaxConns != nil && *p.MaxConns < 0 {
+		return nil, invalidParams("max_conns can't be negative")
+	}
+
+	stats := d.session.Stats()
+	download, upload := stats.DownloadRate, stats.UploadRate
+	if p.DownloadRate != nil {
+		download = *p.DownloadRate
+	}
+	if p.UploadRate != nil {
+		upload = *p.UploadRate
+	}
+	d.session.SetRateLimits(download, upload)
+	if p.MaxConns != nil {
+		d.session.SetMaxConns(*p.MaxConns)
+	}
+	return d.rpcStats(nil)
+}
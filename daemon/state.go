@@ -0,0 +1,131 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/Richd0tcom/bookish-chainsaw/magnet"
+	"github.com/Richd0tcom/bookish-chainsaw/torrentfile"
+)
+
+// the state directory holds torrents.json and a torrents directory with a
+// <infohash>.torrent for each torrent, magnets included once their metadata
+// arrived. Magnets still fetching are kept in the list as their URI
+
+type savedState struct {
+	Torrents []savedTorrent `json:"torrents"`
+}
+
+type savedTorrent struct {
+	InfoHash string `json:"info_hash"`
+	Path     string `json:"path"`
+	Paused   bool   `json:"paused"`
+
+	//set for magnets still fetching metadata. They have no .torrent yet and
+	//Path is the directory the torrent goes below
+	Magnet string `json:"magnet,omitempty"`
+}
+
+func statePath(stateDir string) string {
+	return filepath.Join(stateDir, "torrents.json")
+}
+
+func torrentsDir(stateDir string) string {
+	return filepath.Join(stateDir, "torrents")
+}
+
+func torrentPath(stateDir string, infoHash [20]byte) string {
+	return filepath.Join(torrentsDir(stateDir), hex.EncodeToString(infoHash[:])+".torrent")
+}
+
+// load adds the saved torrents to the session. Torrents that can't be read are skipped
+func (d *Daemon) load() error {
+	buf, err := os.ReadFile(statePath(d.cfg.StateDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state savedState
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return err
+	}
+
+	for _, saved := range state.Torrents {
+		if saved.Magnet != "" {
+			d.restoreMagnet(saved)
+			continue
+		}
+		tf, err := torrentfile.OpenFile(filepath.Join(torrentsDir(d.cfg.StateDir), saved.InfoHash+".torrent"))
+		if err != nil {
+			log.Printf("Could not restore torrent %s: %v\n", saved.InfoHash, err)
+			continue
+		}
+		if saved.Paused {
+			_, err = d.session.AddPaused(tf, saved.Path)
+		} else {
+			_, err = d.session.Add(tf, saved.Path)
+		}
+		if err != nil {
+			log.Printf("Could not restore torrent %s: %v\n", saved.InfoHash, err)
+		}
+	}
+	log.Printf("Restored %d torrents\n", len(d.session.Torrents()))
+	return nil
+}
+
+// restoreMagnet starts fetching the metadata of a saved magnet again
+func (d *Daemon) restoreMagnet(saved savedTorrent) {
+	m, err := magnet.Parse(saved.Magnet)
+	if err == nil {
+		d.mu.Lock()
+		_, err = d.fetchMagnet(saved.Magnet, m, saved.Path, saved.Paused)
+		d.mu.Unlock()
+	}
+	if err != nil {
+		log.Printf("Could not restore magnet %s: %v\n", saved.InfoHash, err)
+	}
+}
+
+// save writes the torrent list. Callers hold d.mu
+func (d *Daemon) save() error {
+	state := savedState{Torrents: []savedTorrent{}}
+	for _, t := range d.session.Torrents() {
+		ih := t.File().InfoHash
+		st, _ := t.State()
+		state.Torrents = append(state.Torrents, savedTorrent{
+			InfoHash: hex.EncodeToString(ih[:]),
+			Path:     t.Path(),
+			Paused:   st == torrentfile.StatePaused,
+		})
+	}
+
+	for _, pm := range d.fetching {
+		state.Torrents = append(state.Torrents, savedTorrent{
+			InfoHash: hex.EncodeToString(pm.m.InfoHash[:]),
+			Path:     pm.dir,
+			Paused:   pm.paused,
+			Magnet:   pm.uri,
+		})
+	}
+
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write then rename, so a crash never leaves half a list behind
+	tmp := statePath(d.cfg.StateDir) + ".tmp"
+	err = os.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath(d.cfg.StateDir))
+}
@@ -0,0 +1,129 @@
+package dht
+
+import (
+	"fmt"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bencode"
+)
+
+// KRPC is a bencoded dictionary sent over UDP. y is "q" for queries,
+// "r" for responses and "e" for errors. t is a transaction ID the
+// response echoes back
+
+// error codes from BEP 5
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+type krpcMsg struct {
+	T string
+	Y string
+	Q string
+	A map[string]interface{}
+	R map[string]interface{}
+	E []interface{}
+}
+
+// KRPCError is returned when a node answers a query with an error
+type KRPCError struct {
+	Code    int64
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+func encodeMsg(m *krpcMsg) ([]byte, error) {
+	dict := map[string]interface{}{
+		"t": m.T,
+		"y": m.Y,
+	}
+	switch m.Y {
+	case "q":
+		dict["q"] = m.Q
+		dict["a"] = m.A
+	case "r":
+		dict["r"] = m.R
+	case "e":
+		dict["e"] = m.E
+	}
+
+	return bencode.Marshal(dict)
+}
+
+func decodeMsg(data []byte) (*krpcMsg, error) {
+	var decoded interface{}
+	err := bencode.Unmarshal(data, &decoded)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("krpc message is not a dictionary")
+	}
+
+	m := &krpcMsg{}
+	m.T, _ = dict["t"].(string)
+	m.Y, _ = dict["y"].(string)
+	if m.T == "" {
+		return nil, fmt.Errorf("krpc message has no transaction ID")
+	}
+
+	switch m.Y {
+	case "q":
+		m.Q, _ = dict["q"].(string)
+		m.A, ok = dict["a"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("krpc query has no arguments")
+		}
+	case "r":
+		m.R, ok = dict["r"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("krpc response has no return values")
+		}
+	case "e":
+		m.E, _ = dict["e"].([]interface{})
+	default:
+		return nil, fmt.Errorf("unknown krpc message type %q", m.Y)
+	}
+	return m, nil
+}
+
+func (m *krpcMsg) err() error {
+	if m.Y != "e" {
+		return nil
+	}
+	e := &KRPCError{Code: errGeneric}
+	if len(m.E) > 0 {
+		if code, ok := m.E[0].(int64); ok {
+			e.Code = code
+		}
+	}
+	if len(m.E) > 1 {
+		e.Message, _ = m.E[1].(string)
+	}
+	return e
+}
+
+func getString(dict map[string]interface{}, key string) (string, bool) {
+	s, ok := dict[key].(string)
+	return s, ok
+}
+
+func getInt(dict map[string]interface{}, key string) (int64, bool) {
+	i, ok := dict[key].(int64)
+	return i, ok
+}
+
+// returns the 20 byte ID stored under key
+func getID(dict map[string]interface{}, key string) (NodeID, error) {
+	s, ok := getString(dict, key)
+	if !ok || len(s) != 20 {
+		return NodeID{}, fmt.Errorf("krpc message has malformed %s", key)
+	}
+	return NodeID([]byte(s)), nil
+}
@@ -0,0 +1,204 @@
+package dht
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// alpha is the number of queries a lookup keeps in flight at once
+const alpha = 3
+
+// lookup walks the network towards target, asking the closest nodes it
+// knows for even closer ones until the K closest have all answered
+type lookup struct {
+	s      *Server
+	target NodeID
+
+	mu        sync.Mutex
+	shortlist []*Node
+	seen      map[string]bool
+	queried   map[string]bool
+
+	//only filled in by get_peers lookups
+	peers  []peers.Peer
+	tokens map[string]string
+}
+
+func (s *Server) newLookup(target NodeID) *lookup {
+	l := &lookup{
+		s:       s,
+		target:  target,
+		seen:    make(map[string]bool),
+		queried: make(map[string]bool),
+		tokens:  make(map[string]string),
+	}
+	l.add(s.table.closest(target, K))
+	return l
+}
+
+func (l *lookup) add(nodes []*Node) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, n := range nodes {
+		key := n.Addr.String()
+		if n.ID == l.s.id || l.seen[key] {
+			continue
+		}
+		l.seen[key] = true
+		l.shortlist = append(l.shortlist, n)
+	}
+	sort.Slice(l.shortlist, func(i, j int) bool {
+		return closer(l.target, l.shortlist[i].ID, l.shortlist[j].ID)
+	})
+}
+
+// next returns up to alpha of the K closest nodes that haven't been queried yet
+func (l *lookup) next() []*Node {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	batch := []*Node{}
+	for i, n := range l.shortlist {
+		if i >= K || len(batch) >= alpha {
+			break
+		}
+		key := n.Addr.String()
+		if l.queried[key] {
+			continue
+		}
+		l.queried[key] = true
+		batch = append(batch, n)
+	}
+	return batch
+}
+
+// run queries nodes until no closer ones turn up. query is called for each
+// node and returns the nodes it learned about
+func (l *lookup) run(query func(n *Node) ([]*Node, error)) {
+	for {
+		batch := l.next()
+		if len(batch) == 0 {
+			return
+		}
+
+		wg := sync.WaitGroup{}
+		for _, n := range batch {
+			wg.Add(1)
+			go func(n *Node) {
+				defer wg.Done()
+				found, err := query(n)
+				if err != nil {
+					l.s.table.remove(n.ID)
+					l.drop(n)
+					return
+				}
+				l.add(found)
+			}(n)
+		}
+		wg.Wait()
+	}
+}
+
+// drop removes a node that didn't answer so it doesn't count towards the K closest
+func (l *lookup) drop(dead *Node) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, n := range l.shortlist {
+		if n.Addr.String() == dead.Addr.String() {
+			l.shortlist = append(l.shortlist[:i], l.shortlist[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *lookup) closest() []*Node {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := min(len(l.shortlist), K)
+	return append([]*Node{}, l.shortlist[:count]...)
+}
+
+// FindNode returns the K closest nodes to target that answered us
+func (s *Server) FindNode(target NodeID) ([]*Node, error) {
+	l := s.newLookup(target)
+	if len(l.shortlist) == 0 {
+		return nil, fmt.Errorf("routing table is empty, bootstrap first")
+	}
+
+	l.run(func(n *Node) ([]*Node, error) {
+		return s.findNode(n.Addr, target)
+	})
+	return l.closest(), nil
+}
+
+func (s *Server) getPeersLookup(infoHash [20]byte) (*lookup, error) {
+	l := s.newLookup(NodeID(infoHash))
+	if len(l.shortlist) == 0 {
+		return nil, fmt.Errorf("routing table is empty, bootstrap first")
+	}
+
+	found := make(map[string]bool)
+	l.run(func(n *Node) ([]*Node, error) {
+		res, err := s.getPeers(n.Addr, infoHash)
+		if err != nil {
+			return nil, err
+		}
+
+		l.mu.Lock()
+		if res.token != "" {
+			l.tokens[n.Addr.String()] = res.token
+		}
+		for _, p := range res.peers {
+			if found[p.String()] {
+				continue
+			}
+			found[p.String()] = true
+			l.peers = append(l.peers, p)
+		}
+		l.mu.Unlock()
+
+		return res.nodes, nil
+	})
+	return l, nil
+}
+
+// GetPeers looks up peers for a torrent
+func (s *Server) GetPeers(infoHash [20]byte) ([]peers.Peer, error) {
+	l, err := s.getPeersLookup(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	return l.peers, nil
+}
+
+// Announce looks up peers for a torrent and tells the closest nodes that
+// we are downloading it on port. It returns the peers found along the way
+func (s *Server) Announce(infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	l, err := s.getPeersLookup(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	announced := 0
+	for _, n := range l.closest() {
+		token, ok := l.tokens[n.Addr.String()]
+		if !ok {
+			continue
+		}
+		err := s.announcePeer(n.Addr, infoHash, port, token)
+		if err != nil {
+			continue
+		}
+		announced++
+	}
+	if announced == 0 && len(l.peers) == 0 {
+		return nil, fmt.Errorf("no DHT node accepted our announce")
+	}
+	return l.peers, nil
+}
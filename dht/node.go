@@ -0,0 +1,100 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"time"
+)
+
+// NodeID identifies a node in the DHT. It lives in the same 160 bit space as infohashes
+type NodeID [20]byte
+
+// Node is a DHT node we know the address of
+type Node struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+
+	//last time the node answered us or sent us a query
+	lastSeen time.Time
+}
+
+// compact node info is 20 bytes of ID followed by a 6 byte compact IPv4 address
+const compactNodeSize = 26
+
+func RandomID() (NodeID, error) {
+	var id NodeID
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+// returns the XOR distance between two IDs
+func distance(a, b NodeID) NodeID {
+	var d NodeID
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// returns true if a is closer to target than b
+func closer(target, a, b NodeID) bool {
+	da := distance(target, a)
+	db := distance(target, b)
+	for i := range da {
+		if da[i] != db[i] {
+			return da[i] < db[i]
+		}
+	}
+	return false
+}
+
+// returns the number of leading bits a and b have in common
+func commonPrefixLen(a, b NodeID) int {
+	d := distance(a, b)
+	for i := range d {
+		if d[i] != 0 {
+			return i*8 + bits.LeadingZeros8(d[i])
+		}
+	}
+	return len(d) * 8
+}
+
+func encodeNodes(nodes []*Node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeSize)
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.Addr.Port))
+	}
+	return string(buf)
+}
+
+func decodeNodes(compact string) ([]*Node, error) {
+	if len(compact)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("received malformed nodes of length %d", len(compact))
+	}
+
+	nodes := make([]*Node, 0, len(compact)/compactNodeSize)
+	for offset := 0; offset < len(compact); offset += compactNodeSize {
+		entry := []byte(compact[offset : offset+compactNodeSize])
+		n := &Node{
+			ID: NodeID(entry[0:20]),
+			Addr: &net.UDPAddr{
+				IP:   net.IP(entry[20:24]),
+				Port: int(binary.BigEndian.Uint16(entry[24:26])),
+			},
+		}
+		if n.Addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCommonPrefixLen(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b NodeID
+		want int
+	}{
+		{"equal", NodeID{0xff}, NodeID{0xff}, 160},
+		{"first bit differs", NodeID{0x80}, NodeID{}, 0},
+		{"second byte differs", NodeID{0x12, 0x01}, NodeID{0x12, 0x00}, 15},
+		{"last bit differs", NodeID{19: 1}, NodeID{}, 159},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := commonPrefixLen(tt.a, tt.b)
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloser(t *testing.T) {
+	target := NodeID{0x10}
+	near := NodeID{0x11}
+	far := NodeID{0x90}
+
+	if !closer(target, near, far) {
+		t.Error("near node is not closer than far node")
+	}
+	if closer(target, far, near) {
+		t.Error("far node is closer than near node")
+	}
+	if closer(target, near, near) {
+		t.Error("node is closer than itself")
+	}
+}
+
+func TestCompactNodesRoundTrip(t *testing.T) {
+	nodes := []*Node{
+		{ID: NodeID{1}, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}},
+		{ID: NodeID{2}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 51413}},
+	}
+
+	decoded, err := decodeNodes(encodeNodes(nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(nodes) {
+		t.Fatalf("got %d nodes, want %d", len(decoded), len(nodes))
+	}
+	for i, n := range decoded {
+		if n.ID != nodes[i].ID || n.Addr.String() != nodes[i].Addr.String() {
+			t.Errorf("node %d is %x %s, want %x %s", i, n.ID, n.Addr, nodes[i].ID, nodes[i].Addr)
+		}
+	}
+}
+
+func TestDecodeNodesMalformed(t *testing.T) {
+	_, err := decodeNodes(string(make([]byte, compactNodeSize+1)))
+	if err == nil {
+		t.Error("nodes of the wrong length were accepted")
+	}
+
+	// port 0 can't be reached, so the node is skipped
+	nodes, err := decodeNodes(string(make([]byte, compactNodeSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 0 {
+		t.Errorf("got %d nodes, want none", len(nodes))
+	}
+}
@@ -0,0 +1,556 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// DefaultBootstrapNodes are well known routers used to join the mainline DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// Config holds the settings for a DHT Server
+type Config struct {
+	//UDP address to listen on, e.g. ":6881" or "127.0.0.1:0"
+	Addr string
+
+	//our node ID. A random one is picked if left empty
+	NodeID NodeID
+
+	//host:port of nodes used to join the network
+	BootstrapNodes []string
+
+	//how long to wait for an answer to a query. Defaults to 2 seconds
+	QueryTimeout time.Duration
+}
+
+// tokens are valid for the current and the previous secret, so between 5 and 10 minutes
+const secretRotation = 5 * time.Minute
+
+// announced peers are forgotten after this long
+const peerExpiry = 30 * time.Minute
+
+// the most peers we hand out in a single get_peers response
+const maxValues = 50
+
+// anyone can announce to us, so we only remember this many peers per infohash
+// and peers for this many infohashes
+const (
+	maxPeersPerHash = 100
+	maxInfoHashes   = 1000
+)
+
+// how often expired peers are forgotten, whether anyone asks for them or not
+const expireInterval = time.Minute
+
+// ErrClosed is returned by queries on a closed Server
+var ErrClosed = errors.New("dht server closed")
+
+// Server is a DHT node. It answers queries from other nodes and runs lookups for us
+type Server struct {
+	id      NodeID
+	conn    *net.UDPConn
+	table   *table
+	timeout time.Duration
+
+	bootstrapNodes []string
+
+	mu      sync.Mutex
+	pending map[string]pendingQuery //by transaction ID
+	closed  bool
+	done    chan struct{} //closed by Close
+
+	secrets     [2][]byte
+	secretSetAt time.Time
+	storedPeers map[[20]byte]map[string]storedPeer
+}
+
+// pendingQuery waits for the response from the node a query went to
+type pendingQuery struct {
+	addr *net.UDPAddr
+	ch   chan *krpcMsg
+}
+
+type storedPeer struct {
+	peer  peers.Peer
+	added time.Time
+}
+
+// New starts a DHT node listening on cfg.Addr. Call Bootstrap to join the network
+func New(cfg Config) (*Server, error) {
+	if cfg.NodeID == (NodeID{}) {
+		id, err := RandomID()
+		if err != nil {
+			return nil, err
+		}
+		cfg.NodeID = id
+	}
+	if cfg.QueryTimeout == 0 {
+		cfg.QueryTimeout = 2 * time.Second
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		id:             cfg.NodeID,
+		conn:           conn,
+		table:          newTable(cfg.NodeID),
+		timeout:        cfg.QueryTimeout,
+		bootstrapNodes: cfg.BootstrapNodes,
+		pending:        make(map[string]pendingQuery),
+		done:           make(chan struct{}),
+		storedPeers:    make(map[[20]byte]map[string]storedPeer),
+	}
+	err = s.rotateSecrets()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go s.readLoop()
+	go s.expireLoop()
+	return s, nil
+}
+
+// ID returns our node ID
+func (s *Server) ID() NodeID {
+	return s.id
+}
+
+// Addr returns the UDP address we listen on
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// NumNodes returns the number of nodes in the routing table
+func (s *Server) NumNodes() int {
+	return s.table.size()
+}
+
+// Close stops the server. Pending queries fail with ErrClosed
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for t, q := range s.pending {
+		close(q.ch)
+		delete(s.pending, t)
+	}
+	s.mu.Unlock()
+
+	return s.conn.Close()
+}
+
+// Bootstrap joins the network through the configured bootstrap nodes and
+// fills the routing table with nodes close to our own ID
+func (s *Server) Bootstrap() error {
+	wg := sync.WaitGroup{}
+	for _, hostport := range s.bootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp4", hostport)
+		if err != nil {
+			log.Printf("Could not resolve DHT bootstrap node %s: %v\n", hostport, err)
+			continue
+		}
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			s.findNode(addr, s.id)
+		}(addr)
+	}
+	wg.Wait()
+
+	if s.table.size() == 0 {
+		return fmt.Errorf("no DHT bootstrap node answered")
+	}
+
+	_, err := s.FindNode(s.id)
+	return err
+}
+
+// Ping checks whether the node at addr is alive and adds it to the routing table
+func (s *Server) Ping(addr *net.UDPAddr) (NodeID, error) {
+	resp, err := s.query(addr, "ping", map[string]interface{}{})
+	if err != nil {
+		return NodeID{}, err
+	}
+	return getID(resp.R, "id")
+}
+
+func (s *Server) findNode(addr *net.UDPAddr, target NodeID) ([]*Node, error) {
+	resp, err := s.query(addr, "find_node", map[string]interface{}{
+		"target": string(target[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	compact, _ := getString(resp.R, "nodes")
+	nodes, err := decodeNodes(compact)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		s.table.insert(n)
+	}
+	return nodes, nil
+}
+
+type getPeersResult struct {
+	peers []peers.Peer
+	nodes []*Node
+	token string
+}
+
+func (s *Server) getPeers(addr *net.UDPAddr, infoHash [20]byte) (*getPeersResult, error) {
+	resp, err := s.query(addr, "get_peers", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &getPeersResult{}
+	res.token, _ = getString(resp.R, "token")
+
+	compact, _ := getString(resp.R, "nodes")
+	res.nodes, err = decodeNodes(compact)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range res.nodes {
+		s.table.insert(n)
+	}
+
+	values, _ := resp.R["values"].([]interface{})
+	for _, v := range values {
+		compactPeer, ok := v.(string)
+		if !ok {
+			continue
+		}
+		ps, err := peers.ParsePeers([]byte(compactPeer))
+		if err != nil {
+			continue
+		}
+		res.peers = append(res.peers, ps...)
+	}
+	return res, nil
+}
+
+func (s *Server) announcePeer(addr *net.UDPAddr, infoHash [20]byte, port uint16, token string) error {
+	_, err := s.query(addr, "announce_peer", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port":      int(port),
+		"token":     token,
+	})
+	return err
+}
+
+// query sends a query to addr and waits for the matching response
+func (s *Server) query(addr *net.UDPAddr, q string, args map[string]interface{}) (*krpcMsg, error) {
+	args["id"] = string(s.id[:])
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	t, err := s.newTxID()
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	ch := make(chan *krpcMsg, 1)
+	s.pending[t] = pendingQuery{addr: addr, ch: ch}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, t)
+		s.mu.Unlock()
+	}()
+
+	err = s.send(addr, &krpcMsg{T: t, Y: "q", Q: q, A: args})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, ErrClosed
+		}
+		err = resp.err()
+		if err != nil {
+			return nil, err
+		}
+		id, err := getID(resp.R, "id")
+		if err != nil {
+			return nil, err
+		}
+		s.table.insert(&Node{ID: id, Addr: addr})
+		return resp, nil
+	case <-time.After(s.timeout):
+		return nil, fmt.Errorf("%s query to %s timed out", q, addr)
+	}
+}
+
+// newTxID returns a random transaction ID that isn't in use, so nodes we didn't
+// query can't guess it and slip in a response. Called with s.mu held
+func (s *Server) newTxID() (string, error) {
+	buf := make([]byte, 4)
+	for {
+		_, err := rand.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := s.pending[string(buf)]; !ok {
+			return string(buf), nil
+		}
+	}
+}
+
+func (s *Server) send(addr *net.UDPAddr, m *krpcMsg) error {
+	buf, err := encodeMsg(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDP(buf, addr)
+	return err
+}
+
+func (s *Server) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		m, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		switch m.Y {
+		case "q":
+			s.handleQuery(addr, m)
+		case "r", "e":
+			// hold the lock so Close can't close the channel under us
+			s.mu.Lock()
+			q, ok := s.pending[m.T]
+			// only the node we asked may answer
+			if ok && q.addr.IP.Equal(addr.IP) && q.addr.Port == addr.Port {
+				select {
+				case q.ch <- m:
+				default:
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Server) handleQuery(addr *net.UDPAddr, m *krpcMsg) {
+	id, err := getID(m.A, "id")
+	if err != nil {
+		s.sendError(addr, m.T, errProtocol, err.Error())
+		return
+	}
+
+	r := map[string]interface{}{"id": string(s.id[:])}
+
+	switch m.Q {
+	case "ping":
+	case "find_node":
+		target, err := getID(m.A, "target")
+		if err != nil {
+			s.sendError(addr, m.T, errProtocol, err.Error())
+			return
+		}
+		r["nodes"] = encodeNodes(s.table.closest(target, K))
+	case "get_peers":
+		infoHash, err := getID(m.A, "info_hash")
+		if err != nil {
+			s.sendError(addr, m.T, errProtocol, err.Error())
+			return
+		}
+		r["token"] = s.token(addr.IP, 0)
+		values := s.peersFor(infoHash)
+		if len(values) > 0 {
+			r["values"] = values
+		} else {
+			r["nodes"] = encodeNodes(s.table.closest(NodeID(infoHash), K))
+		}
+	case "announce_peer":
+		infoHash, err := getID(m.A, "info_hash")
+		if err != nil {
+			s.sendError(addr, m.T, errProtocol, err.Error())
+			return
+		}
+		token, _ := getString(m.A, "token")
+		if !s.validToken(addr.IP, token) {
+			s.sendError(addr, m.T, errProtocol, "bad token")
+			return
+		}
+		port, _ := getInt(m.A, "port")
+		if implied, _ := getInt(m.A, "implied_port"); implied != 0 {
+			port = int64(addr.Port)
+		}
+		if port <= 0 || port > 65535 {
+			s.sendError(addr, m.T, errProtocol, "bad port")
+			return
+		}
+		s.storePeer(infoHash, peers.Peer{IP: addr.IP, Port: uint16(port)})
+	default:
+		s.sendError(addr, m.T, errMethodUnknown, "method unknown")
+		return
+	}
+
+	// a node that talks to us is alive, so it's worth remembering
+	s.table.insert(&Node{ID: id, Addr: addr})
+	s.send(addr, &krpcMsg{T: m.T, Y: "r", R: r})
+}
+
+func (s *Server) sendError(addr *net.UDPAddr, t string, code int, msg string) {
+	s.send(addr, &krpcMsg{T: t, Y: "e", E: []interface{}{code, msg}})
+}
+
+func (s *Server) rotateSecrets() error {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return err
+	}
+	s.secrets[1] = s.secrets[0]
+	s.secrets[0] = secret
+	s.secretSetAt = time.Now()
+	return nil
+}
+
+// token returns the token handed to ip, derived from one of our secrets
+func (s *Server) token(ip net.IP, secret int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.secretSetAt) > secretRotation {
+		s.rotateSecrets()
+	}
+	if s.secrets[secret] == nil {
+		return ""
+	}
+	h := sha1.New()
+	h.Write(ip.To16())
+	h.Write(s.secrets[secret])
+	return string(h.Sum(nil))
+}
+
+func (s *Server) validToken(ip net.IP, token string) bool {
+	if token == "" {
+		return false
+	}
+	return token == s.token(ip, 0) || token == s.token(ip, 1)
+}
+
+func (s *Server) storePeer(infoHash [20]byte, p peers.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.storedPeers[infoHash]
+	if !ok {
+		if len(s.storedPeers) >= maxInfoHashes {
+			return
+		}
+		stored = make(map[string]storedPeer)
+		s.storedPeers[infoHash] = stored
+	}
+
+	key := p.String()
+	if _, ok := stored[key]; !ok && len(stored) >= maxPeersPerHash {
+		// make room by forgetting the peer that announced longest ago
+		oldest := ""
+		for k, sp := range stored {
+			if oldest == "" || sp.added.Before(stored[oldest].added) {
+				oldest = k
+			}
+		}
+		delete(stored, oldest)
+	}
+	stored[key] = storedPeer{peer: p, added: time.Now()}
+}
+
+// expireLoop forgets expired peers every expireInterval until the server is closed
+func (s *Server) expireLoop() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.expirePeers()
+	}
+}
+
+func (s *Server) expirePeers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for infoHash, stored := range s.storedPeers {
+		for key, sp := range stored {
+			if time.Since(sp.added) > peerExpiry {
+				delete(stored, key)
+			}
+		}
+		if len(stored) == 0 {
+			delete(s.storedPeers, infoHash)
+		}
+	}
+}
+
+// returns compact peers announced for infoHash, dropping expired ones
+func (s *Server) peersFor(infoHash [20]byte) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := []interface{}{}
+	for key, sp := range s.storedPeers[infoHash] {
+		if time.Since(sp.added) > peerExpiry {
+			delete(s.storedPeers[infoHash], key)
+			continue
+		}
+		ip := sp.peer.IP.To4()
+		if ip == nil || len(values) >= maxValues {
+			continue
+		}
+		compact := binary.BigEndian.AppendUint16(append([]byte{}, ip...), sp.peer.Port)
+		values = append(values, string(compact))
+	}
+	return values
+}
@@ -0,0 +1,306 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// newTestNode starts a node on localhost that is closed when the test ends
+func newTestNode(t *testing.T, bootstrap ...string) *Server {
+	t.Helper()
+
+	s, err := New(Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: bootstrap,
+		QueryTimeout:   500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// newTestNetwork starts n nodes that joined through the first one
+func newTestNetwork(t *testing.T, n int) []*Server {
+	t.Helper()
+
+	seed := newTestNode(t)
+	nodes := []*Server{seed}
+	for i := 1; i < n; i++ {
+		node := newTestNode(t, seed.Addr().String())
+		err := node.Bootstrap()
+		if err != nil {
+			t.Fatalf("node %d could not bootstrap: %v", i, err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// silentAddr returns a localhost address that never answers
+func silentAddr(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestPing(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+
+	id, err := a.Ping(b.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != b.ID() {
+		t.Errorf("got ID %x, want %x", id, b.ID())
+	}
+	if a.NumNodes() != 1 {
+		t.Errorf("querying node knows %d nodes, want 1", a.NumNodes())
+	}
+	if b.NumNodes() != 1 {
+		t.Errorf("queried node knows %d nodes, want 1", b.NumNodes())
+	}
+}
+
+func TestBootstrapWithoutAnswer(t *testing.T) {
+	node := newTestNode(t, silentAddr(t).String())
+
+	err := node.Bootstrap()
+	if err == nil {
+		t.Fatal("bootstrap through a silent node succeeded")
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	last := nodes[len(nodes)-1]
+
+	target, err := RandomID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := last.FindNode(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != K {
+		t.Fatalf("got %d nodes, want %d", len(found), K)
+	}
+	for i := 1; i < len(found); i++ {
+		if closer(target, found[i].ID, found[i-1].ID) {
+			t.Errorf("node %d is closer to the target than node %d", i, i-1)
+		}
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := newTestNetwork(t, 6)
+	infoHash := [20]byte{1, 2, 3}
+
+	_, err := nodes[1].Announce(infoHash, 6000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, err := nodes[4].GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || !ps[0].IP.Equal(net.IPv4(127, 0, 0, 1)) || ps[0].Port != 6000 {
+		t.Errorf("got peers %v, want 127.0.0.1:6000", ps)
+	}
+
+	ps, err = nodes[4].GetPeers([20]byte{4, 5, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 0 {
+		t.Errorf("got peers %v for a torrent nobody announced", ps)
+	}
+}
+
+func TestAnnouncePeerBadToken(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+
+	err := a.announcePeer(b.Addr(), [20]byte{1}, 6000, "not a token")
+	var krpcErr *KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errProtocol {
+		t.Fatalf("got %v, want a protocol error", err)
+	}
+
+	ps, err := a.getPeers(b.Addr(), [20]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.peers) != 0 {
+		t.Errorf("peer was stored despite the bad token: %v", ps.peers)
+	}
+}
+
+func TestGetPeersBeforeBootstrap(t *testing.T) {
+	node := newTestNode(t)
+
+	_, err := node.GetPeers([20]byte{1})
+	if err == nil {
+		t.Fatal("lookup with an empty routing table succeeded")
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	node := newTestNode(t)
+
+	start := time.Now()
+	_, err := node.Ping(silentAddr(t))
+	if err == nil {
+		t.Fatal("ping to a silent node succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("ping gave up after %s, want about 500ms", elapsed)
+	}
+}
+
+func TestCloseFailsPendingQueries(t *testing.T) {
+	node := newTestNode(t)
+	addr := silentAddr(t)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := node.Ping(addr)
+		errs <- err
+	}()
+
+	// give the query time to go out
+	time.Sleep(50 * time.Millisecond)
+	node.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("got %v, want ErrClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pending query did not return after Close")
+	}
+
+	_, err := node.Ping(addr)
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("query after Close returned %v, want ErrClosed", err)
+	}
+}
+
+func TestStoredPeersAreBounded(t *testing.T) {
+	node := newTestNode(t)
+
+	infoHash := [20]byte{1}
+	for i := 0; i < maxPeersPerHash+10; i++ {
+		node.storePeer(infoHash, peers.Peer{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 6881})
+	}
+	if got := len(node.storedPeers[infoHash]); got != maxPeersPerHash {
+		t.Errorf("stored %d peers for one infohash, want %d", got, maxPeersPerHash)
+	}
+	// the newest announce made it in at the cost of the oldest
+	if _, ok := node.storedPeers[infoHash]["10.0.0.0:6881"]; ok {
+		t.Error("the oldest peer was kept")
+	}
+	if _, ok := node.storedPeers[infoHash][fmt.Sprintf("10.0.0.%d:6881", maxPeersPerHash+9)]; !ok {
+		t.Error("the newest peer was dropped")
+	}
+
+	for i := 0; i < maxInfoHashes+10; i++ {
+		node.storePeer([20]byte{2, byte(i >> 8), byte(i)}, peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	}
+	if got := len(node.storedPeers); got != maxInfoHashes {
+		t.Errorf("stored peers for %d infohashes, want %d", got, maxInfoHashes)
+	}
+}
+
+func TestExpirePeers(t *testing.T) {
+	node := newTestNode(t)
+
+	old := [20]byte{1}
+	fresh := [20]byte{2}
+	node.storePeer(old, peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	node.storePeer(fresh, peers.Peer{IP: net.IPv4(10, 0, 0, 2), Port: 6881})
+	for key, sp := range node.storedPeers[old] {
+		sp.added = time.Now().Add(-peerExpiry - time.Minute)
+		node.storedPeers[old][key] = sp
+	}
+
+	node.expirePeers()
+	if _, ok := node.storedPeers[old]; ok {
+		t.Error("expired peers were kept")
+	}
+	if len(node.storedPeers[fresh]) != 1 {
+		t.Error("fresh peers were forgotten")
+	}
+}
+
+func TestResponseFromOtherAddressIgnored(t *testing.T) {
+	node := newTestNode(t)
+	target := silentAddr(t)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := node.Ping(target)
+		errs <- err
+	}()
+
+	// wait for the query to be pending, then answer it from somewhere else
+	var txID string
+	for txID == "" {
+		time.Sleep(10 * time.Millisecond)
+		node.mu.Lock()
+		for t := range node.pending {
+			txID = t
+		}
+		node.mu.Unlock()
+	}
+	spoofer := newTestNode(t)
+	id := spoofer.ID()
+	err := spoofer.send(node.Addr(), &krpcMsg{T: txID, Y: "r", R: map[string]interface{}{"id": string(id[:])}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-errs
+	if err == nil {
+		t.Fatal("accepted a response from a node we didn't query")
+	}
+	if node.NumNodes() != 0 {
+		t.Errorf("the spoofing node made it into the routing table")
+	}
+}
+
+func TestTransactionIDsAreUnique(t *testing.T) {
+	node := newTestNode(t)
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	a, err := node.newTxID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.pending[a] = pendingQuery{}
+	b, err := node.newTxID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("got transaction ID %x twice", a)
+	}
+	delete(node.pending, a)
+}
@@ -0,0 +1,118 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the number of nodes kept per bucket and returned from lookups
+const K = 8
+
+// nodes we haven't heard from in this long may be replaced by new ones
+const staleAfter = 15 * time.Minute
+
+// table is a Kademlia routing table. Bucket i holds the nodes whose IDs
+// share exactly i leading bits with ours
+type table struct {
+	mu      sync.Mutex
+	self    NodeID
+	buckets [160][]*Node
+}
+
+func newTable(self NodeID) *table {
+	return &table{self: self}
+}
+
+// insert adds a node or refreshes it if we already know it. A full bucket
+// only makes room by evicting a stale node
+func (t *table) insert(n *Node) {
+	if n.ID == t.self {
+		return
+	}
+	// lookups hold on to the node they got, so keep our own copy to update
+	copied := *n
+	n = &copied
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	index := commonPrefixLen(t.self, n.ID)
+	if index >= len(t.buckets) {
+		return
+	}
+	bucket := t.buckets[index]
+	now := time.Now()
+
+	for i, existing := range bucket {
+		if existing.ID == n.ID {
+			existing.Addr = n.Addr
+			existing.lastSeen = now
+			// move to the back so the front of the bucket is least recently seen
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			t.buckets[index] = append(bucket, existing)
+			return
+		}
+	}
+
+	n.lastSeen = now
+	if len(bucket) < K {
+		t.buckets[index] = append(bucket, n)
+		return
+	}
+
+	oldest := bucket[0]
+	if now.Sub(oldest.lastSeen) > staleAfter {
+		t.buckets[index] = append(bucket[1:], n)
+	}
+}
+
+func (t *table) remove(id NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	index := commonPrefixLen(t.self, id)
+	if index >= len(t.buckets) {
+		return
+	}
+	bucket := t.buckets[index]
+	for i, n := range bucket {
+		if n.ID == id {
+			t.buckets[index] = append(bucket[:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns up to count known nodes ordered by distance to target
+func (t *table) closest(target NodeID, count int) []*Node {
+	t.mu.Lock()
+	all := []*Node{}
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			copied := *n
+			all = append(all, &copied)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return closer(target, all[i].ID, all[j].ID)
+	})
+	if len(all) > count {
+		all = all[:count]
+	}
+	return all
+}
+
+// size returns the number of nodes in the table
+func (t *table) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total := 0
+	for _, bucket := range t.buckets {
+		total += len(bucket)
+	}
+	return total
+}
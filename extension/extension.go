@@ -0,0 +1,95 @@
+package extension
+
+import (
+	"fmt"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bencode"
+)
+
+// HandshakeID is the extended message ID reserved for the extension handshake (BEP 10)
+const HandshakeID = 0
+
+// names of the extensions we know about
+const (
+	UTMetadata = "ut_metadata"
+	UTPex      = "ut_pex"
+)
+
+// LocalIDs are the extended message IDs we ask peers to use when they
+// send us messages for each extension. Register new extensions here.
+var LocalIDs = map[string]uint8{
+	UTMetadata: 1,
+	UTPex:      2,
+}
+
+// ClientVersion is sent to peers in the v key
+const ClientVersion = "bookish-chainsaw"
+
+// Handshake is the bencoded dictionary peers swap right after the
+// bittorrent handshake when both set the extension bit
+type Handshake struct {
+	//maps extension names to the message IDs the sender wants to receive them on.
+	//an ID of 0 means the extension is disabled
+	M map[string]int `bencode:"m"`
+
+	V            string `bencode:"v,omitempty"`
+	P            int    `bencode:"p,omitempty"`
+	Reqq         int    `bencode:"reqq,omitempty"`
+	MetadataSize int    `bencode:"metadata_size,omitempty"`
+}
+
+// New creates our extension handshake. metadataSize may be 0 if we don't have the metadata yet.
+// listenPort is sent in the p key, so peers can pass our address on through PEX. 0 leaves it out
+func New(metadataSize int, listenPort uint16) *Handshake {
+	m := make(map[string]int, len(LocalIDs))
+	for name, id := range LocalIDs {
+		m[name] = int(id)
+	}
+	return &Handshake{
+		M:            m,
+		V:            ClientVersion,
+		P:            int(listenPort),
+		MetadataSize: metadataSize,
+	}
+}
+
+// Disable tells the peer we don't take part in the named extension
+func (h *Handshake) Disable(name string) {
+	h.M[name] = 0
+}
+
+func (h *Handshake) Serialize() ([]byte, error) {
+	return bencode.Marshal(h)
+}
+
+// Parse decodes the payload of an extension handshake (without the extended message ID)
+func Parse(payload []byte) (*Handshake, error) {
+	h := Handshake{}
+	err := bencode.Unmarshal(payload, &h)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// ID returns the message ID the peer wants to receive the named extension on
+func (h *Handshake) ID(name string) (uint8, error) {
+	id, ok := h.M[name]
+	if !ok || id == 0 {
+		return 0, fmt.Errorf("peer does not support %s", name)
+	}
+	if id < 0 || id > 255 {
+		return 0, fmt.Errorf("peer sent invalid message ID %d for %s", id, name)
+	}
+	return uint8(id), nil
+}
+
+// LocalName returns the extension a message we received belongs to
+func LocalName(id uint8) (string, bool) {
+	for name, localID := range LocalIDs {
+		if localID == id {
+			return name, true
+		}
+	}
+	return "", false
+}
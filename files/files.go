@@ -0,0 +1,114 @@
+package files
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// File is one file of a torrent. The files of a torrent are laid out back
+// to back, so piece boundaries don't line up with file boundaries
+type File struct {
+	//path components below the torrent root. Empty for single-file torrents,
+	//where the root itself is the file
+	Path []string
+
+	Length int
+
+	//where the file starts in the torrent's byte stream
+	Offset int
+}
+
+// Span is the part of a single file covered by a byte range of the torrent
+type Span struct {
+	//index of the file in the table
+	File int
+
+	//offset within the file
+	Offset int
+
+	Length int
+}
+
+// Table maps the torrent's byte stream onto its files
+type Table []File
+
+// NewTable computes each file's offset from the lengths of the files before it
+func NewTable(fs []File) Table {
+	t := make(Table, len(fs))
+	offset := 0
+	for i, f := range fs {
+		t[i] = File{Path: f.Path, Length: f.Length, Offset: offset}
+		offset += f.Length
+	}
+	return t
+}
+
+// Length returns the total length of all files
+func (t Table) Length() int {
+	if len(t) == 0 {
+		return 0
+	}
+	last := t[len(t)-1]
+	return last.Offset + last.Length
+}
+
+// Spans returns the parts of each file covered by the bytes [begin, end)
+func (t Table) Spans(begin, end int) []Span {
+	spans := []Span{}
+	for i, f := range t {
+		fileEnd := f.Offset + f.Length
+		if fileEnd <= begin || f.Length == 0 {
+			continue
+		}
+		if f.Offset >= end {
+			break
+		}
+
+		from := max(begin, f.Offset)
+		to := min(end, fileEnd)
+		spans = append(spans, Span{File: i, Offset: from - f.Offset, Length: to - from})
+	}
+	return spans
+}
+
+// PieceSpans returns the parts of each file covered by a piece
+func (t Table) PieceSpans(index, pieceLength int) []Span {
+	begin := index * pieceLength
+	end := min(begin+pieceLength, t.Length())
+	return t.Spans(begin, end)
+}
+
+// LocalPath returns where the file lives under root
+func (f File) LocalPath(root string) string {
+	return filepath.Join(append([]string{root}, f.Path...)...)
+}
+
+// SanitizePath checks path components from a torrent so they can't escape
+// the download directory. Separators inside a component are replaced
+func SanitizePath(components []string) ([]string, error) {
+	if len(components) == 0 {
+		return nil, fmt.Errorf("file has an empty path")
+	}
+
+	clean := make([]string, len(components))
+	for i, c := range components {
+		c = strings.Map(func(r rune) rune {
+			switch r {
+			case '/', '\\', 0:
+				return '_'
+			}
+			return r
+		}, c)
+
+		switch c {
+		case "", ".", "..":
+			return nil, fmt.Errorf("file path %q has an unsafe component %q", strings.Join(components, "/"), components[i])
+		}
+		if filepath.VolumeName(c) != "" {
+			return nil, fmt.Errorf("file path %q has a volume name", strings.Join(components, "/"))
+		}
+		clean[i] = c
+	}
+	return clean, nil
+}
@@ -0,0 +1,119 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Set is the open files of a torrent under a root directory. It reads and
+// writes at offsets in the torrent's byte stream
+type Set struct {
+	table Table
+	root  string
+	files []*os.File
+}
+
+// Open opens or creates every file of the table under root, creating directories as needed.
+// Existing data is kept, even past the end of a file that is longer than the torrent says.
+// Such a file may not belong to the torrent at all, the hash check sorts out what is usable
+func Open(root string, t Table) (*Set, error) {
+	s := &Set{table: t, root: root, files: make([]*os.File, len(t))}
+	for i, f := range t {
+		path := f.LocalPath(root)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		s.files[i], err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		// we only ever touch the first f.Length bytes, so leave the rest of someone else's file alone
+		info, err := s.files[i].Stat()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if info.Size() > int64(f.Length) {
+			log.Printf("%s is %d bytes longer than the torrent says, leaving the rest as it is\n", path, info.Size()-int64(f.Length))
+		}
+	}
+	return s, nil
+}
+
+// OpenReadOnly opens the files of the table under root for reading. Files that
+// can't be opened are left out, reading from them fails
+func OpenReadOnly(root string, t Table) *Set {
+	s := &Set{table: t, root: root, files: make([]*os.File, len(t))}
+	for i, f := range t {
+		file, err := os.Open(f.LocalPath(root))
+		if err == nil {
+			s.files[i] = file
+		}
+	}
+	return s
+}
+
+// WriteAt writes p at offset off of the torrent, splitting it across files
+func (s *Set) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+	for _, span := range s.table.Spans(int(off), int(off)+len(p)) {
+		if s.files[span.File] == nil {
+			return written, s.notOpen("write", span.File)
+		}
+		n, err := s.files[span.File].WriteAt(p[written:written+span.Length], int64(span.Offset))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	if written < len(p) {
+		return written, fmt.Errorf("write of %d bytes at offset %d is past the end of the torrent", len(p), off)
+	}
+	return written, nil
+}
+
+// ReadAt reads len(p) bytes at offset off of the torrent, gathering them from each file
+func (s *Set) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for _, span := range s.table.Spans(int(off), int(off)+len(p)) {
+		if s.files[span.File] == nil {
+			return read, s.notOpen("read", span.File)
+		}
+		n, err := s.files[span.File].ReadAt(p[read:read+span.Length], int64(span.Offset))
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (s *Set) notOpen(op string, index int) error {
+	return &os.PathError{Op: op, Path: s.table[index].LocalPath(s.root), Err: os.ErrNotExist}
+}
+
+// Close closes every file
+func (s *Set) Close() error {
+	var firstErr error
+	for _, f := range s.files {
+		if f == nil {
+			continue
+		}
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
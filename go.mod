@@ -1,5 +1,3 @@
 module github.com/Richd0tcom/bookish-chainsaw
 
 go 1.23.2
-
-require github.com/jackpal/bencode-go v1.0.2
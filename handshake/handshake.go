@@ -10,7 +10,7 @@ import (
 //
 //
 //The protocol identifier, called the pstr which is always BitTorrent protocol
-//Eight reserved bytes, all set to 0. We’d flip some of them to 1 to indicate that we support certain extensions. But we don’t, so we’ll keep them at 0.
+//Eight reserved bytes. We flip some of them to 1 to indicate that we support certain extensions (see BEP 4).
 //The infohash that we calculated earlier to identify which file we want
 // The Peer ID that we made up to identify ourselves
 //
@@ -20,19 +20,47 @@ import (
 //A bittorrent handshake is a special message that a peer uses to identify itself
 type Handshake struct {
 	Pstr string //The protocol identifier, called the pstr which is always: "Bittorrent Protocol"
+	Reserved [8]byte //extension bits, see BEP 4
 	InfoHash [20]byte
 	PeerID [20]byte
 }
 
 const BYTE_LEN = 49
 
-// creates a new hand shake
+// reserved bits, given as the byte they live in and the mask within that byte
+const (
+	extensionByte = 5
+	extensionBit  = 0x10 //extension protocol (BEP 10)
+	dhtByte       = 7
+	dhtBit        = 0x01 //DHT (BEP 5)
+	fastByte      = 7
+	fastBit       = 0x04 //fast extension (BEP 6)
+)
+
+// creates a new hand shake. We always advertise the extension protocol
 func New(infoHash, peerID [20]byte) (*Handshake) {
-	return &Handshake{
+	hs := &Handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	hs.Reserved[extensionByte] |= extensionBit
+	return hs
+}
+
+// SupportsExtensions reports whether the extension protocol bit is set
+func (hs *Handshake) SupportsExtensions() bool {
+	return hs.Reserved[extensionByte]&extensionBit != 0
+}
+
+// SupportsDHT reports whether the DHT bit is set
+func (hs *Handshake) SupportsDHT() bool {
+	return hs.Reserved[dhtByte]&dhtBit != 0
+}
+
+// SupportsFast reports whether the fast extension bit is set
+func (hs *Handshake) SupportsFast() bool {
+	return hs.Reserved[fastByte]&fastBit != 0
 }
 
 func (hs *Handshake) Serialize() []byte {
@@ -49,7 +77,7 @@ func (hs *Handshake) Serialize() []byte {
 	buf[0] = byte(len(hs.Pstr))
 	offset :=1
 	offset+= copy(buf[offset:], hs.Pstr)
-	offset+= copy(buf[offset:], make([]byte, 8))
+	offset+= copy(buf[offset:], hs.Reserved[:])
 	offset+= copy(buf[offset:], hs.InfoHash[:])
 	offset+= copy(buf[offset:], hs.PeerID[:])
 
@@ -59,8 +87,9 @@ func (hs *Handshake) Serialize() []byte {
 func (hs *Handshake) DeSerialize(pstrLen int, buf []byte) error {
 	
 	hs.Pstr = string(buf[0:pstrLen])
-	hs.InfoHash = [20]byte(buf[8 + pstrLen: 20 +1])
-	hs.PeerID = [20]byte(buf[8 + pstrLen + 20: ])
+	hs.Reserved = [8]byte(buf[pstrLen : pstrLen+8])
+	hs.InfoHash = [20]byte(buf[pstrLen+8 : pstrLen+28])
+	hs.PeerID = [20]byte(buf[pstrLen+28 : pstrLen+48])
 
 	return nil
 }
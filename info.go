@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/torrentfile"
+)
+
+// torrentInfo is what info prints, and its --json output
+type torrentInfo struct {
+	Name           string     `json:"name"`
+	InfoHash       string     `json:"info_hash"`
+	InfoHashBase32 string     `json:"info_hash_base32"`
+	Length         int        `json:"length"`
+	PieceLength    int        `json:"piece_length"`
+	Pieces         int        `json:"pieces"`
+	Private        bool       `json:"private"`
+	Comment        string     `json:"comment,omitempty"`
+	CreatedBy      string     `json:"created_by,omitempty"`
+	CreationDate   *time.Time `json:"creation_date,omitempty"`
+	Trackers       [][]string `json:"trackers"`
+	WebSeeds       []string   `json:"web_seeds"`
+	Files          []fileInfo `json:"files"`
+	UnknownKeys    []string   `json:"unknown_keys"`
+}
+
+type fileInfo struct {
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+}
+
+func newTorrentInfo(tf torrentfile.TorrentFile) torrentInfo {
+	info := torrentInfo{
+		Name:           tf.Name,
+		InfoHash:       hex.EncodeToString(tf.InfoHash[:]),
+		InfoHashBase32: base32.StdEncoding.EncodeToString(tf.InfoHash[:]),
+		Length:         tf.Length,
+		PieceLength:    tf.PieceLength,
+		Pieces:         len(tf.PieceHashes),
+		Private:        tf.Private,
+		Comment:        tf.Comment,
+		CreatedBy:      tf.CreatedBy,
+		Trackers:       [][]string{},
+		WebSeeds:       []string{},
+		Files:          []fileInfo{},
+		UnknownKeys:    tf.UnknownKeys,
+	}
+	if !tf.CreationDate.IsZero() {
+		info.CreationDate = &tf.CreationDate
+	}
+	// tiers are shuffled when the torrent is parsed, sort them so the output doesn't change between runs
+	for _, tier := range tf.AnnounceList {
+		sorted := append([]string{}, tier...)
+		sort.Strings(sorted)
+		info.Trackers = append(info.Trackers, sorted)
+	}
+	info.WebSeeds = append(info.WebSeeds, tf.WebSeeds...)
+	for _, f := range tf.Files {
+		path := tf.Name
+		if len(f.Path) > 0 {
+			path += "/" + strings.Join(f.Path, "/")
+		}
+		info.Files = append(info.Files, fileInfo{Path: path, Length: f.Length})
+	}
+	return info
+}
+
+// runInfo prints what a .torrent holds without downloading anything
+func runInfo(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print a JSON object instead of text")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s info [-json] <file.torrent>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	tf, err := torrentfile.OpenFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+	info := newTorrentInfo(tf)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(info)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(w, "Info hash:\t%s\n", info.InfoHash)
+	fmt.Fprintf(w, "Info hash (base32):\t%s\n", info.InfoHashBase32)
+	fmt.Fprintf(w, "Size:\t%s (%d bytes)\n", formatSize(info.Length), info.Length)
+	fmt.Fprintf(w, "Pieces:\t%d of %s\n", info.Pieces, formatSize(info.PieceLength))
+	fmt.Fprintf(w, "Private:\t%t\n", info.Private)
+	if info.Comment != "" {
+		fmt.Fprintf(w, "Comment:\t%s\n", info.Comment)
+	}
+	if info.CreatedBy != "" {
+		fmt.Fprintf(w, "Created by:\t%s\n", info.CreatedBy)
+	}
+	if info.CreationDate != nil {
+		fmt.Fprintf(w, "Created:\t%s\n", info.CreationDate.Format(time.RFC3339))
+	}
+	for i, tier := range info.Trackers {
+		fmt.Fprintf(w, "Tier %d:\t%s\n", i+1, strings.Join(tier, " "))
+	}
+	for _, ws := range info.WebSeeds {
+		fmt.Fprintf(w, "Web seed:\t%s\n", ws)
+	}
+	if len(info.UnknownKeys) > 0 {
+		fmt.Fprintf(w, "Unknown keys:\t%s\n", strings.Join(info.UnknownKeys, ", "))
+	}
+	w.Flush()
+
+	fmt.Printf("Files (%d):\n", len(info.Files))
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, f := range info.Files {
+		fmt.Fprintf(w, "  %d\t  %s\n", f.Length, f.Path)
+	}
+	w.Flush()
+}
+
+// formatSize prints n bytes in the largest binary unit that keeps it at or above 1
+func formatSize(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := unit, 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
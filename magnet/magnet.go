@@ -0,0 +1,111 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// Magnet holds the parts of a magnet URI we care about
+type Magnet struct {
+	InfoHash [20]byte
+
+	//display name. may be empty
+	Name string
+
+	//tracker URLs from the tr parameters
+	Trackers []string
+
+	//peers from the x.pe parameters
+	Peers []peers.Peer
+}
+
+const btihPrefix = "urn:btih:"
+
+// Parse parses a magnet:?xt=urn:btih:... URI
+func Parse(uri string) (Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Magnet{}, err
+	}
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("expected magnet URI but got scheme %q", u.Scheme)
+	}
+
+	query := u.Query()
+
+	m := Magnet{
+		Name:     query.Get("dn"),
+		Trackers: query["tr"],
+	}
+
+	found := false
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(xt, btihPrefix) {
+			continue
+		}
+		m.InfoHash, err = parseInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return Magnet{}, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return Magnet{}, fmt.Errorf("magnet URI has no urn:btih exact topic")
+	}
+
+	for _, pe := range query["x.pe"] {
+		p, err := parsePeer(pe)
+		if err != nil {
+			return Magnet{}, err
+		}
+		m.Peers = append(m.Peers, p)
+	}
+
+	return m, nil
+}
+
+// the infohash is either 40 hex characters or 32 base32 characters
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	var raw []byte
+	var err error
+
+	switch len(s) {
+	case 40:
+		raw, err = hex.DecodeString(s)
+	case 32:
+		raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return infoHash, fmt.Errorf("received malformed infohash of length %d", len(s))
+	}
+	if err != nil {
+		return infoHash, err
+	}
+
+	copy(infoHash[:], raw)
+	return infoHash, nil
+}
+
+func parsePeer(s string) (peers.Peer, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return peers.Peer{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return peers.Peer{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return peers.Peer{}, fmt.Errorf("x.pe peer %q is not an IP address", s)
+	}
+	return peers.Peer{IP: ip, Port: uint16(port)}, nil
+}
@@ -1,17 +1,59 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/Richd0tcom/bookish-chainsaw/torrentfile"
 )
 
+// subcommands, run as bookish-chainsaw <command> [args]. Anything else is a download
+var commands = map[string]func(args []string){
+	"scrape": runScrape,
+	"create": runCreate,
+	"info":   runInfo,
+	"verify": runVerify,
+	"daemon": runDaemon,
+}
+
 func main() {
-	inPath := os.Args[1]
-	outPath := os.Args[2]
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Float64Var(&torrentfile.SeedRatio, "seed-ratio", torrentfile.SeedRatio, "stop seeding after uploading this many times the torrent's size (0 disables seeding)")
+	flag.DurationVar(&torrentfile.SeedTime, "seed-time", torrentfile.SeedTime, "stop seeding after this long")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <file.torrent|magnet URI> <output path>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s scrape <file.torrent>...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s create [flags] <file or directory>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s info [-json] <file.torrent>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s verify [-q] <file.torrent> <path>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s daemon [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	inPath := flag.Arg(0)
+	outPath := flag.Arg(1)
 
-	tf, err := torrentfile.OpenFile(inPath)
+	var tf torrentfile.TorrentFile
+	var err error
+	if strings.HasPrefix(inPath, "magnet:") {
+		tf, err = torrentfile.OpenMagnet(inPath)
+	} else {
+		tf, err = torrentfile.OpenFile(inPath)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
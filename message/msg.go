@@ -18,6 +18,9 @@ const (
 	MSG_REQUEST
 	MSG_PIECE
 	MSG_CANCEL
+
+	// MSG_EXTENDED carries extension protocol messages (BEP 10)
+	MSG_EXTENDED messageID = 20
 )
 
 // Message stores ID and payload of a message
@@ -84,6 +87,36 @@ func FormatRequest(index, begin, length int) *Message {
 	return &Message{ID: MSG_REQUEST, Payload: payload}
 }
 
+// FormatPiece creates a PIECE message carrying a block of a piece
+func FormatPiece(index, begin int, data []byte) *Message {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return &Message{ID: MSG_PIECE, Payload: payload}
+}
+
+// ParseRequest parses a REQUEST message. CANCEL messages have the same layout and are parsed too
+func ParseRequest(m *Message) (index, begin, length int, err error) {
+	if m.ID != MSG_REQUEST && m.ID != MSG_CANCEL {
+		return 0, 0, 0, fmt.Errorf("expected REQUEST (ID %d) or CANCEL (ID %d), got ID %d", MSG_REQUEST, MSG_CANCEL, m.ID)
+	}
+	if len(m.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12, got length %d", len(m.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(m.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// FormatCancel creates a CANCEL message for a block we requested earlier
+func FormatCancel(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MSG_CANCEL
+	return msg
+}
+
 // FormatHave creates a HAVE message
 func FormatHave(index int) *Message {
 	payload := make([]byte, 4)
@@ -91,6 +124,25 @@ func FormatHave(index int) *Message {
 	return &Message{ID: MSG_HAVE, Payload: payload}
 }
 
+// FormatExtended creates an EXTENDED message. extID 0 is the extension handshake
+func FormatExtended(extID uint8, payload []byte) *Message {
+	buf := make([]byte, len(payload)+1)
+	buf[0] = extID
+	copy(buf[1:], payload)
+	return &Message{ID: MSG_EXTENDED, Payload: buf}
+}
+
+// ParseExtended splits an EXTENDED message into its extended message ID and payload
+func ParseExtended(m *Message) (uint8, []byte, error) {
+	if m.ID != MSG_EXTENDED {
+		return 0, nil, fmt.Errorf("expected EXTENDED (ID %d), got ID %d", MSG_EXTENDED, m.ID)
+	}
+	if len(m.Payload) < 1 {
+		return 0, nil, fmt.Errorf("expected payload length at least 1, got length %d", len(m.Payload))
+	}
+	return m.Payload[0], m.Payload[1:], nil
+}
+
 // ParsePiece parses a PIECE message and copies its payload into a buffer
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 
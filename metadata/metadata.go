@@ -0,0 +1,195 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bencode"
+	"github.com/Richd0tcom/bookish-chainsaw/client"
+	"github.com/Richd0tcom/bookish-chainsaw/extension"
+	"github.com/Richd0tcom/bookish-chainsaw/message"
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// fetches the info dictionary of a torrent from peers using the
+// ut_metadata extension (BEP 9)
+
+// BlockSize is the size of every metadata piece except the last one
+const BlockSize = 16384 //16KB
+
+// MaxSize guards against peers announcing absurd metadata sizes
+const MaxSize = 8 * 1024 * 1024
+
+const (
+	msgTypeRequest = iota
+	msgTypeData
+	msgTypeReject
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// Fetch asks each peer in turn for the info dictionary until one of
+// them hands over bytes that hash to infoHash
+func Fetch(ps []peers.Peer, infoHash, peerID [20]byte) ([]byte, error) {
+	for _, p := range ps {
+		info, err := fetchFromPeer(p, infoHash, peerID)
+		if err != nil {
+			log.Printf("Could not fetch metadata from %s: %v\n", p, err)
+			continue
+		}
+		return info, nil
+	}
+	return nil, fmt.Errorf("could not fetch metadata from any of %d peers", len(ps))
+}
+
+func fetchFromPeer(p peers.Peer, infoHash, peerID [20]byte) ([]byte, error) {
+	// peers without a single piece still have the metadata, so don't wait for a bitfield
+	c, err := client.Dial(p, infoHash, peerID, 0, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Conn.Close()
+
+	// the whole exchange should be quick, metadata is rarely more than a few hundred KB
+	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	if !c.SupportsExtensions() {
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	// the extension handshake may still be on its way, after a bitfield, HAVEs or keep-alives
+	for c.Extensions == nil {
+		_, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !c.SupportsExtension(extension.UTMetadata) {
+		return nil, fmt.Errorf("peer does not support %s", extension.UTMetadata)
+	}
+	size := c.Extensions.MetadataSize
+	if size <= 0 || size > MaxSize {
+		return nil, fmt.Errorf("peer sent invalid metadata size %d", size)
+	}
+
+	info := make([]byte, size)
+	numPieces := (size + BlockSize - 1) / BlockSize
+
+	for i := 0; i < numPieces; i++ {
+		payload, err := formatRequest(i)
+		if err != nil {
+			return nil, err
+		}
+		err = c.SendExtended(extension.UTMetadata, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	localID := extension.LocalIDs[extension.UTMetadata]
+	// peers may send a piece twice, so count each index once
+	arrived := make([]bool, numPieces)
+	received := 0
+	for received < numPieces {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MSG_EXTENDED {
+			continue
+		}
+		extID, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+		if extID != localID {
+			continue
+		}
+
+		piece, data, err := parseData(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		begin := piece * BlockSize
+		if piece < 0 || piece >= numPieces {
+			return nil, fmt.Errorf("peer sent metadata piece %d out of bounds", piece)
+		}
+		// every piece but the last is full, anything shorter would leave a hole
+		if len(data) != min(BlockSize, len(info)-begin) {
+			return nil, fmt.Errorf("peer sent %d bytes for metadata piece %d", len(data), piece)
+		}
+		if arrived[piece] {
+			continue
+		}
+		copy(info[begin:], data)
+		arrived[piece] = true
+		received++
+	}
+
+	hash := sha1.Sum(info)
+	if !bytes.Equal(hash[:], infoHash[:]) {
+		return nil, fmt.Errorf("metadata failed integrity check")
+	}
+	return info, nil
+}
+
+// a data message is a bencoded dictionary immediately followed by the raw piece
+func parseData(payload []byte) (int, []byte, error) {
+	dec := bencode.NewDecoder(bytes.NewReader(payload))
+
+	msg := metadataMsg{}
+	err := dec.Decode(&msg)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	switch msg.MsgType {
+	case msgTypeData:
+	case msgTypeReject:
+		return 0, nil, fmt.Errorf("peer rejected metadata piece %d", msg.Piece)
+	default:
+		return 0, nil, fmt.Errorf("unexpected ut_metadata msg_type %d", msg.MsgType)
+	}
+
+	return msg.Piece, payload[dec.InputOffset():], nil
+}
+
+// Reply returns the answer to a ut_metadata message a peer sent us: the
+// requested piece of info, or a reject if we don't have info. Messages that
+// need no answer get nil
+func Reply(info []byte, payload []byte) ([]byte, error) {
+	msg := metadataMsg{}
+	err := bencode.NewDecoder(bytes.NewReader(payload)).Decode(&msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.MsgType != msgTypeRequest {
+		return nil, nil
+	}
+
+	begin := msg.Piece * BlockSize
+	if len(info) == 0 || msg.Piece < 0 || begin >= len(info) {
+		return bencode.Marshal(metadataMsg{MsgType: msgTypeReject, Piece: msg.Piece})
+	}
+	end := min(begin+BlockSize, len(info))
+
+	reply, err := bencode.Marshal(metadataMsg{MsgType: msgTypeData, Piece: msg.Piece, TotalSize: len(info)})
+	if err != nil {
+		return nil, err
+	}
+	return append(reply, info[begin:end]...), nil
+}
+
+func formatRequest(piece int) ([]byte, error) {
+	return bencode.Marshal(metadataMsg{MsgType: msgTypeRequest, Piece: piece})
+}
@@ -8,7 +8,7 @@ import (
 	"time"
 )
 
-// Peer encodes connection information for a peer
+// Peer encodes connection information for a peer. IP is either an IPv4 or an IPv6 address
 type Peer struct {
     IP   net.IP
     Port uint16
@@ -39,6 +39,38 @@ func ParsePeers (peersListBin []byte) ([]Peer, error){
     return peers,  nil
 }
 
+//IPv6 peers are 18 bytes long, 16 for the address and 2 for the port
+const peer6Size int = 18
+
+// ParsePeers6 parses a compact list of IPv6 peers
+func ParsePeers6(peersListBin []byte) ([]Peer, error) {
+    if len(peersListBin)%peer6Size != 0 {
+        return nil, fmt.Errorf("received malformed IPv6 peers")
+    }
+
+    peers := make([]Peer, len(peersListBin)/peer6Size)
+    for i := range peers {
+        offset := i * peer6Size
+        peers[i].IP = net.IP(peersListBin[offset : offset+16])
+        peers[i].Port = binary.BigEndian.Uint16(peersListBin[offset+16 : offset+18])
+    }
+    return peers, nil
+}
+
+// Compact packs peers into the compact format ParsePeers and ParsePeers6 read.
+// IPv4 peers end up in v4 and IPv6 peers in v6
+func Compact(ps []Peer) (v4 []byte, v6 []byte) {
+    for _, p := range ps {
+        port := binary.BigEndian.AppendUint16(nil, p.Port)
+        if ip := p.IP.To4(); ip != nil {
+            v4 = append(append(v4, ip...), port...)
+        } else if ip := p.IP.To16(); ip != nil {
+            v6 = append(append(v6, ip...), port...)
+        }
+    }
+    return v4, v6
+}
+
 func StartConnection(ps []Peer) {
     for _, p := range ps {
         go func (p *Peer) {
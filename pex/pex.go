@@ -0,0 +1,107 @@
+package pex
+
+import (
+	"github.com/Richd0tcom/bookish-chainsaw/bencode"
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// peer exchange (ut_pex). Peers tell each other about the peers they are
+// connected to, so a swarm holds together even when the tracker only knows a few
+
+// MaxPeers is the most added or dropped peers a single message carries
+const MaxPeers = 50
+
+// flags describing an added peer
+const (
+	FlagEncryption = 0x01 //prefers encrypted connections
+	FlagSeed       = 0x02 //has every piece
+	FlagUTP        = 0x04
+	FlagHolepunch  = 0x08
+	FlagReachable  = 0x10 //accepts incoming connections
+)
+
+// Message lists the peers the sender connected to and disconnected from since its last message
+type Message struct {
+	Added []peers.Peer
+	//Flags[i] describes Added[i]
+	Flags   []byte
+	Dropped []peers.Peer
+}
+
+type bencodeMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// Parse decodes the payload of a ut_pex message (without the extended message ID)
+func Parse(payload []byte) (*Message, error) {
+	bm := bencodeMessage{}
+	err := bencode.Unmarshal(payload, &bm)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{}
+	added, err := peers.ParsePeers([]byte(bm.Added))
+	if err != nil {
+		return nil, err
+	}
+	m.Added = append(m.Added, added...)
+	m.Flags = append(m.Flags, flags(bm.AddedF, len(added))...)
+
+	added6, err := peers.ParsePeers6([]byte(bm.Added6))
+	if err != nil {
+		return nil, err
+	}
+	m.Added = append(m.Added, added6...)
+	m.Flags = append(m.Flags, flags(bm.Added6F, len(added6))...)
+
+	dropped, err := peers.ParsePeers([]byte(bm.Dropped))
+	if err != nil {
+		return nil, err
+	}
+	dropped6, err := peers.ParsePeers6([]byte(bm.Dropped6))
+	if err != nil {
+		return nil, err
+	}
+	m.Dropped = append(dropped, dropped6...)
+
+	return m, nil
+}
+
+// flags returns one flag byte per peer. Peers missing from f get none
+func flags(f string, n int) []byte {
+	out := make([]byte, n)
+	copy(out, f)
+	return out
+}
+
+// Serialize encodes the message, splitting the peers into their IPv4 and IPv6 lists
+func (m *Message) Serialize() ([]byte, error) {
+	bm := bencodeMessage{}
+
+	for i, p := range m.Added {
+		var f byte
+		if i < len(m.Flags) {
+			f = m.Flags[i]
+		}
+		v4, v6 := peers.Compact([]peers.Peer{p})
+		if len(v4) > 0 {
+			bm.Added += string(v4)
+			bm.AddedF += string(f)
+		} else if len(v6) > 0 {
+			bm.Added6 += string(v6)
+			bm.Added6F += string(f)
+		}
+	}
+
+	v4, v6 := peers.Compact(m.Dropped)
+	bm.Dropped = string(v4)
+	bm.Dropped6 = string(v6)
+
+	return bencode.Marshal(bm)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Richd0tcom/bookish-chainsaw/torrentfile"
+)
+
+// runScrape prints the swarm statistics of each torrent without downloading anything
+func runScrape(args []string) {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s scrape <file.torrent>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TORRENT\tSEEDERS\tLEECHERS\tCOMPLETED\tTRACKER")
+	for _, path := range fs.Args() {
+		tf, err := torrentfile.OpenFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+			continue
+		}
+
+		res, tracker, err := tf.Scrape()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", tf.Name, res.Seeders, res.Leechers, res.Completed, tracker)
+	}
+	w.Flush()
+
+	if failed {
+		os.Exit(1)
+	}
+}
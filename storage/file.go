@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/Richd0tcom/bookish-chainsaw/files"
+)
+
+// File stores pieces in the torrent's files. Single-file torrents are written
+// to the path itself, multi-file torrents below it
+type File struct {
+	Path string
+
+	//never create or change files. Writes fail and missing files read as errors
+	ReadOnly bool
+}
+
+// NewFile returns file storage rooted at path
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+// OpenTorrent opens or creates the torrent's files. Existing data is kept
+func (fs *File) OpenTorrent(info *Info) (Torrent, error) {
+	if fs.ReadOnly {
+		return &fileTorrent{info: info, set: files.OpenReadOnly(fs.Path, info.Files)}, nil
+	}
+	set, err := files.Open(fs.Path, info.Files)
+	if err != nil {
+		return nil, err
+	}
+	return &fileTorrent{info: info, set: set}, nil
+}
+
+type fileTorrent struct {
+	info *Info
+	set  *files.Set
+
+	mu     sync.RWMutex //held for reading by reads and writes, so Close waits for them
+	closed bool
+}
+
+func (ft *fileTorrent) ReadPiece(index, begin int, p []byte) (int, error) {
+	off, err := ft.info.Offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	ft.mu.RLock()
+	defer ft.mu.RUnlock()
+
+	if ft.closed {
+		return 0, ErrClosed
+	}
+	return ft.set.ReadAt(p, off)
+}
+
+func (ft *fileTorrent) WritePiece(index, begin int, p []byte) (int, error) {
+	off, err := ft.info.Offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	ft.mu.RLock()
+	defer ft.mu.RUnlock()
+
+	if ft.closed {
+		return 0, ErrClosed
+	}
+	return ft.set.WriteAt(p, off)
+}
+
+// MarkComplete does nothing, the data is already in the files
+func (ft *fileTorrent) MarkComplete(index int) error {
+	return nil
+}
+
+func (ft *fileTorrent) Close() error {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if ft.closed {
+		return nil
+	}
+	ft.closed = true
+	return ft.set.Close()
+}
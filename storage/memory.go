@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Memory keeps every torrent in memory. Handy for tests and small torrents,
+// everything is lost once the process exits
+type Memory struct {
+	mu       sync.Mutex
+	torrents map[[20]byte]*memoryData
+}
+
+// NewMemory returns empty memory storage
+func NewMemory() *Memory {
+	return &Memory{torrents: make(map[[20]byte]*memoryData)}
+}
+
+// OpenTorrent returns the torrent's data, allocating it the first time.
+// Opening a torrent again after Close gives back what was written before
+func (m *Memory) OpenTorrent(info *Info) (Torrent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	md, ok := m.torrents[info.InfoHash]
+	if !ok {
+		md = &memoryData{data: make([]byte, info.Length)}
+		m.torrents[info.InfoHash] = md
+	}
+	if len(md.data) != info.Length {
+		return nil, fmt.Errorf("torrent %x is already stored with length %d", info.InfoHash, len(md.data))
+	}
+	return &memoryTorrent{info: info, md: md}, nil
+}
+
+// memoryData outlives the torrents opened on it
+type memoryData struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+type memoryTorrent struct {
+	info *Info
+	md   *memoryData
+
+	closed bool //guarded by md.mu
+}
+
+func (mt *memoryTorrent) ReadPiece(index, begin int, p []byte) (int, error) {
+	off, err := mt.info.Offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	mt.md.mu.RLock()
+	defer mt.md.mu.RUnlock()
+
+	if mt.closed {
+		return 0, ErrClosed
+	}
+	return copy(p, mt.md.data[off:]), nil
+}
+
+func (mt *memoryTorrent) WritePiece(index, begin int, p []byte) (int, error) {
+	off, err := mt.info.Offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	mt.md.mu.Lock()
+	defer mt.md.mu.Unlock()
+
+	if mt.closed {
+		return 0, ErrClosed
+	}
+	return copy(mt.md.data[off:], p), nil
+}
+
+// MarkComplete does nothing, there is nowhere else for the data to go
+func (mt *memoryTorrent) MarkComplete(index int) error {
+	return nil
+}
+
+// Close keeps the data around, so the torrent can be opened again
+func (mt *memoryTorrent) Close() error {
+	mt.md.mu.Lock()
+	defer mt.md.mu.Unlock()
+
+	mt.closed = true
+	return nil
+}
@@ -0,0 +1,164 @@
+//go:build linux || darwin
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Mmap stores pieces in the torrent's files like File, but maps them into
+// memory so reads and writes are plain copies. Files are grown to their full
+// length up front
+type Mmap struct {
+	Path string
+}
+
+// NewMmap returns mmap storage rooted at path
+func NewMmap(path string) *Mmap {
+	return &Mmap{Path: path}
+}
+
+// OpenTorrent creates the torrent's files at their full length and maps them
+func (ms *Mmap) OpenTorrent(info *Info) (Torrent, error) {
+	mt := &mmapTorrent{info: info, maps: make([][]byte, len(info.Files))}
+	for i, f := range info.Files {
+		if f.Length == 0 {
+			// empty files can't be mapped, but should still exist
+			err := createFile(f.LocalPath(ms.Path), 0)
+			if err != nil {
+				mt.Close()
+				return nil, err
+			}
+			continue
+		}
+
+		data, err := mapFile(f.LocalPath(ms.Path), f.Length)
+		if err != nil {
+			mt.Close()
+			return nil, err
+		}
+		mt.maps[i] = data
+	}
+	return mt, nil
+}
+
+func createFile(path string, length int) error {
+	f, err := openFile(path, length)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// openFile opens or creates the file at path and grows it to length bytes.
+// Longer files are not cut, only their first length bytes are mapped
+func openFile(path string, length int) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() >= int64(length) {
+		return f, nil
+	}
+	err = f.Truncate(int64(length))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func mapFile(path string, length int) ([]byte, error) {
+	f, err := openFile(path, length)
+	if err != nil {
+		return nil, err
+	}
+	// the mapping stays valid after the file is closed
+	defer f.Close()
+
+	return syscall.Mmap(int(f.Fd()), 0, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+type mmapTorrent struct {
+	info *Info
+	maps [][]byte //per file, nil for empty files
+
+	//held for reading by reads and writes, touching a mapping after Close unmapped it crashes
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (mt *mmapTorrent) ReadPiece(index, begin int, p []byte) (int, error) {
+	off, err := mt.info.Offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	if mt.closed {
+		return 0, ErrClosed
+	}
+	read := 0
+	for _, span := range mt.info.Files.Spans(int(off), int(off)+len(p)) {
+		read += copy(p[read:], mt.maps[span.File][span.Offset:span.Offset+span.Length])
+	}
+	return read, nil
+}
+
+func (mt *mmapTorrent) WritePiece(index, begin int, p []byte) (int, error) {
+	off, err := mt.info.Offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	if mt.closed {
+		return 0, ErrClosed
+	}
+	written := 0
+	for _, span := range mt.info.Files.Spans(int(off), int(off)+len(p)) {
+		written += copy(mt.maps[span.File][span.Offset:span.Offset+span.Length], p[written:])
+	}
+	return written, nil
+}
+
+// MarkComplete does nothing, the kernel writes dirty pages back to the files
+func (mt *mmapTorrent) MarkComplete(index int) error {
+	return nil
+}
+
+func (mt *mmapTorrent) Close() error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.closed = true
+	var firstErr error
+	for i, data := range mt.maps {
+		if data == nil {
+			continue
+		}
+		err := syscall.Munmap(data)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		mt.maps[i] = nil
+	}
+	return firstErr
+}
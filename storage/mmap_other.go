@@ -0,0 +1,20 @@
+//go:build !(linux || darwin)
+
+package storage
+
+import "fmt"
+
+// Mmap is only supported on linux and darwin. Use File elsewhere
+type Mmap struct {
+	Path string
+}
+
+// NewMmap returns mmap storage rooted at path
+func NewMmap(path string) *Mmap {
+	return &Mmap{Path: path}
+}
+
+// OpenTorrent always fails on this platform
+func (ms *Mmap) OpenTorrent(info *Info) (Torrent, error) {
+	return nil, fmt.Errorf("mmap storage is not supported on this platform")
+}
@@ -0,0 +1,30 @@
+//go:build linux || darwin
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmapRoundTrip(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "test")
+	roundTrip(t, NewMmap(root))
+
+	// the empty file exists and the others were grown to their full length
+	for _, f := range testInfo().Files {
+		fi, err := os.Stat(f.LocalPath(root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(f.Length) {
+			t.Errorf("%s is %d bytes, want %d", fi.Name(), fi.Size(), f.Length)
+		}
+	}
+}
+
+func TestMmapKeepsLongerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test")
+	keepsLongerFile(t, NewMmap(path), path)
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Richd0tcom/bookish-chainsaw/files"
+)
+
+// Storage is where torrents keep their pieces. The file, mmap and memory
+// implementations are built in, anything else can be plugged into comms.Torrent
+type Storage interface {
+	OpenTorrent(info *Info) (Torrent, error)
+}
+
+// ErrClosed is returned by reads and writes on a Torrent after Close
+var ErrClosed = errors.New("torrent storage is closed")
+
+// Torrent is the data of one open torrent. Reads and writes are at an offset
+// within a piece and never cross into the next one
+type Torrent interface {
+	ReadPiece(index, begin int, p []byte) (int, error)
+	WritePiece(index, begin int, p []byte) (int, error)
+
+	//called once a piece is written and passed its integrity check
+	MarkComplete(index int) error
+
+	Close() error
+}
+
+// Info is the layout of a torrent's data
+type Info struct {
+	InfoHash    [20]byte
+	Name        string
+	PieceLength int
+	Length      int
+
+	//how the data is split into files. A single file for single-file torrents
+	Files files.Table
+}
+
+// NumPieces returns the number of pieces of the torrent
+func (info *Info) NumPieces() int {
+	return (info.Length + info.PieceLength - 1) / info.PieceLength
+}
+
+// PieceSize returns the length of a piece. Only the last one can be shorter
+func (info *Info) PieceSize(index int) int {
+	begin := index * info.PieceLength
+	return min(begin+info.PieceLength, info.Length) - begin
+}
+
+// Offset checks that n bytes at begin fit in the piece and returns where they
+// start in the torrent's byte stream
+func (info *Info) Offset(index, begin, n int) (int64, error) {
+	if index < 0 || index >= info.NumPieces() {
+		return 0, fmt.Errorf("piece %d out of range", index)
+	}
+	if begin < 0 || begin+n > info.PieceSize(index) {
+		return 0, fmt.Errorf("%d bytes at %d are past the end of piece %d", n, begin, index)
+	}
+	return int64(index*info.PieceLength + begin), nil
+}
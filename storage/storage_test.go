@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Richd0tcom/bookish-chainsaw/files"
+)
+
+// testInfo is a torrent of three files whose pieces cross file boundaries
+func testInfo() *Info {
+	table := files.NewTable([]files.File{
+		{Path: []string{"a"}, Length: 10},
+		{Path: []string{"b"}, Length: 0},
+		{Path: []string{"dir", "c"}, Length: 25},
+	})
+	return &Info{InfoHash: [20]byte{1}, Name: "test", PieceLength: 16, Length: table.Length(), Files: table}
+}
+
+// roundTrip writes every piece, reads them back, closes and checks that reads then fail
+func roundTrip(t *testing.T, st Storage) {
+	t.Helper()
+
+	info := testInfo()
+	data, err := st.OpenTorrent(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([][]byte, info.NumPieces())
+	for i := range want {
+		want[i] = bytes.Repeat([]byte{byte(i + 1)}, info.PieceSize(i))
+		n, err := data.WritePiece(i, 0, want[i])
+		if err != nil {
+			t.Fatalf("writing piece %d: %v", i, err)
+		}
+		if n != len(want[i]) {
+			t.Fatalf("wrote %d bytes of piece %d, want %d", n, i, len(want[i]))
+		}
+	}
+
+	for i := range want {
+		got := make([]byte, len(want[i]))
+		_, err := data.ReadPiece(i, 0, got)
+		if err != nil {
+			t.Fatalf("reading piece %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want[i]) {
+			t.Errorf("piece %d read back as %v, want %v", i, got, want[i])
+		}
+	}
+
+	// a block in the middle of the piece that spans every file
+	got := make([]byte, 4)
+	_, err = data.ReadPiece(0, 8, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want[0][8:12]) {
+		t.Errorf("block read back as %v, want %v", got, want[0][8:12])
+	}
+
+	_, err = data.ReadPiece(0, 10, make([]byte, 16))
+	if err == nil {
+		t.Error("read past the end of a piece succeeded")
+	}
+
+	err = data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = data.ReadPiece(0, 0, make([]byte, 4))
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("read after Close returned %v, want ErrClosed", err)
+	}
+	_, err = data.WritePiece(0, 0, make([]byte, 4))
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("write after Close returned %v, want ErrClosed", err)
+	}
+}
+
+func TestMemoryRoundTrip(t *testing.T) {
+	roundTrip(t, NewMemory())
+}
+
+func TestMemoryKeepsDataAfterClose(t *testing.T) {
+	st := NewMemory()
+	roundTrip(t, st)
+
+	data, err := st.OpenTorrent(testInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	got := make([]byte, 4)
+	_, err = data.ReadPiece(1, 0, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{2, 2, 2, 2}) {
+		t.Errorf("reopened torrent read %v, want what was written before", got)
+	}
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	roundTrip(t, NewFile(filepath.Join(t.TempDir(), "test")))
+}
+
+// keepsLongerFile checks that opening st over a file longer than the torrent's leaves all of it alone
+func keepsLongerFile(t *testing.T, st Storage, path string) {
+	t.Helper()
+
+	existing := bytes.Repeat([]byte{9}, 100)
+	err := os.WriteFile(path, existing, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := files.NewTable([]files.File{{Length: 40}})
+	data, err := st.OpenTorrent(&Info{InfoHash: [20]byte{2}, PieceLength: 16, Length: 40, Files: table})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = data.WritePiece(0, 0, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.Close()
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(make([]byte, 16), existing[16:]...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("file is %d bytes after opening the torrent, want the first piece written and the rest of its 100 bytes kept", len(got))
+	}
+}
+
+func TestFileKeepsLongerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test")
+	keepsLongerFile(t, NewFile(path), path)
+}
@@ -0,0 +1,179 @@
+package torrentfile
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/comms"
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// DefaultAnnounceInterval is used when a tracker doesn't say how long to wait
+var DefaultAnnounceInterval = 30 * time.Minute
+
+// AnnounceRetry is how long we wait before asking a tier that failed again.
+// It doubles with every failure up to DefaultAnnounceInterval
+var AnnounceRetry = time.Minute
+
+// StoppedTimeout is the longest we wait for trackers to hear that we stopped
+var StoppedTimeout = 10 * time.Second
+
+// announcer keeps every tracker tier up to date while a torrent runs. Each tier
+// gets a started event, regular re-announces with our real counters, completed
+// once the download finishes and stopped when we shut down. Peers from every
+// announce are handed to the running torrent
+type announcer struct {
+	tf      *TorrentFile
+	torrent *comms.Torrent
+	peerID  [20]byte
+	port    uint16
+
+	//our own copy, announceTier moves trackers that answer to the front
+	tiers [][]string
+
+	completed chan struct{}
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	mu        sync.Mutex //start must not add tiers to wg once close is waiting for it
+
+	//cancelled by close, so announces in flight give up
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var errAnnouncerClosed = errors.New("announcer closed")
+
+type tierResult struct {
+	peers []peers.Peer
+	err   error
+}
+
+func newAnnouncer(tf *TorrentFile, torrent *comms.Torrent, peerID [20]byte, port uint16) *announcer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &announcer{
+		tf:        tf,
+		torrent:   torrent,
+		peerID:    peerID,
+		port:      port,
+		tiers:     tf.copyTiers(),
+		completed: make(chan struct{}),
+		stop:      make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// start asks the tiers in order like announceTiers and returns the peers of
+// every tier that answered, so the download has peers to begin with. Tiers
+// are still started in order after it returns. Each keeps announcing in the
+// background until close and hands its peers to the torrent
+func (a *announcer) start() ([]peers.Peer, error) {
+	return askTiers(len(a.tiers), func(i int) <-chan tierResult {
+		first := make(chan tierResult, 1)
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		select {
+		case <-a.stop:
+			first <- tierResult{err: errAnnouncerClosed}
+			return first
+		default:
+		}
+		a.wg.Add(1)
+		go a.runTier(a.tiers[i], first)
+		return first
+	}, a.stop)
+}
+
+// complete tells the trackers the download finished
+func (a *announcer) complete() {
+	close(a.completed)
+}
+
+// close gives up on announces in flight, sends stopped to every tier that knows
+// about us and waits for them. Stopped announces give up after StoppedTimeout
+func (a *announcer) close() {
+	a.mu.Lock()
+	close(a.stop)
+	a.mu.Unlock()
+	a.cancel()
+	a.wg.Wait()
+}
+
+func (a *announcer) request(event string) announceRequest {
+	return announceRequest{
+		PeerID:     a.peerID,
+		Port:       a.port,
+		Uploaded:   a.torrent.Uploaded(),
+		Downloaded: a.torrent.Downloaded(),
+		Left:       a.torrent.Left(),
+		Event:      event,
+	}
+}
+
+// runTier announces to a tier until close. The result of the first announce goes to first
+func (a *announcer) runTier(tier []string, first chan<- tierResult) {
+	defer a.wg.Done()
+
+	event := eventStarted
+	started := false
+	completed := a.completed
+	wait := time.Duration(0)
+	retry := AnnounceRetry
+
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-a.stop:
+			timer.Stop()
+			if first != nil {
+				first <- tierResult{err: errAnnouncerClosed}
+			}
+			if started {
+				ctx, cancel := context.WithTimeout(context.Background(), StoppedTimeout)
+				a.tf.announceTier(ctx, tier, a.request(eventStopped))
+				cancel()
+			}
+			return
+		case <-completed:
+			// tell the tracker right away. If it never saw started it still sees left=0
+			timer.Stop()
+			completed = nil
+			if started {
+				event = eventCompleted
+			}
+		case <-timer.C:
+		}
+
+		resp, err := a.tf.announceTier(a.ctx, tier, a.request(event))
+		if first != nil {
+			res := tierResult{err: err}
+			if resp != nil {
+				res.peers = resp.Peers
+			}
+			first <- res
+			first = nil
+		}
+		if err != nil {
+			wait = retry
+			retry = min(retry*2, DefaultAnnounceInterval)
+			continue
+		}
+
+		if event == eventStarted {
+			started = true
+		}
+		event = eventNone
+		retry = AnnounceRetry
+		if a.ctx.Err() == nil {
+			a.torrent.AddPeers(resp.Peers)
+		}
+
+		wait = resp.Interval
+		if wait <= 0 {
+			wait = DefaultAnnounceInterval
+		}
+		wait = max(wait, resp.MinInterval)
+	}
+}
@@ -0,0 +1,230 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bencode"
+	"github.com/Richd0tcom/bookish-chainsaw/files"
+)
+
+// bounds of the piece length Create picks on its own
+const (
+	MinPieceLength = 16 * 1024        //16KB
+	MaxPieceLength = 16 * 1024 * 1024 //16MB
+)
+
+// Create aims for about this many pieces, so the piece hashes stay small for big torrents
+const targetPieces = 1500
+
+// CreateOptions describes a torrent for Create. Only the content is required
+type CreateOptions struct {
+	//name of the torrent, defaults to the base name of the content
+	Name string
+
+	//bytes per piece. 0 picks one from the content's size
+	PieceLength int
+
+	//tiers of trackers. The first tracker also goes into announce
+	AnnounceList [][]string
+
+	Comment   string
+	CreatedBy string
+	//left out when zero
+	CreationDate time.Time
+
+	//asks clients to only get peers from the trackers
+	Private bool
+
+	//HTTP servers holding the content
+	WebSeeds []string
+}
+
+// Create makes a bencoded .torrent of a file or of every regular file below a
+// directory. Pieces are hashed in parallel
+func Create(path string, opts CreateOptions) ([]byte, error) {
+	root := filepath.Clean(path)
+	table, err := contentTable(root)
+	if err != nil {
+		return nil, err
+	}
+	length := table.Length()
+	if length == 0 {
+		return nil, fmt.Errorf("%s has no data to share", path)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = pickPieceLength(length)
+	}
+	if pieceLength < 0 {
+		return nil, fmt.Errorf("invalid piece length %d", pieceLength)
+	}
+
+	pieces, err := hashContent(root, table, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	info := bencodeInfo{
+		Pieces:      string(pieces),
+		PieceLength: pieceLength,
+		Name:        opts.Name,
+	}
+	if info.Name == "" {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		info.Name = filepath.Base(abs)
+	}
+	if len(table) == 1 && len(table[0].Path) == 0 {
+		info.Length = length
+	} else {
+		for _, f := range table {
+			info.Files = append(info.Files, bencodeFile{Length: f.Length, Path: f.Path})
+		}
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+
+	bto := bencodeTorrent{
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+	}
+	if len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		bto.Announce = opts.AnnounceList[0][0]
+	}
+	// a single tier is all announce says already
+	if len(opts.AnnounceList) == 1 && len(opts.AnnounceList[0]) == 1 {
+		bto.AnnounceList = nil
+	}
+	if !opts.CreationDate.IsZero() {
+		bto.CreationDate = opts.CreationDate.Unix()
+	}
+	if len(opts.WebSeeds) > 0 {
+		bto.URLList, err = bencode.Marshal(opts.WebSeeds)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bto.RawInfo, err = bencode.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return bencode.Marshal(bto)
+}
+
+// contentTable lists the files below root in lexical order. A root that is a
+// file makes a single-file torrent. The root itself may be a symlink
+func contentTable(root string) (files.Table, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return files.NewTable([]files.File{{Length: int(stat.Size())}}), nil
+	}
+
+	// WalkDir doesn't follow a symlinked root, it would only see the link
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []files.File{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// symlinks and devices are left out, like other clients do
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		found = append(found, files.File{
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+			Length: int(info.Size()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%s has no files", root)
+	}
+	return files.NewTable(found), nil
+}
+
+// pickPieceLength doubles the piece length from MinPieceLength until the
+// torrent has at most targetPieces pieces or MaxPieceLength is reached
+func pickPieceLength(length int) int {
+	pieceLength := MinPieceLength
+	for pieceLength < MaxPieceLength && length/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// hashContent returns the SHA-1 of every piece back to back
+func hashContent(root string, table files.Table, pieceLength int) ([]byte, error) {
+	set := files.OpenReadOnly(root, table)
+	defer set.Close()
+
+	length := table.Length()
+	numPieces := (length + pieceLength - 1) / pieceLength
+	hashes := make([]byte, numPieces*sha1.Size)
+	indexes := make(chan int)
+
+	var errOnce sync.Once
+	var firstErr error
+	wg := sync.WaitGroup{}
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for index := range indexes {
+				size := min(pieceLength, length-index*pieceLength)
+				_, err := set.ReadAt(buf[:size], int64(index*pieceLength))
+				if err != nil {
+					// the files changed while we were hashing
+					errOnce.Do(func() { firstErr = err })
+					continue
+				}
+				hash := sha1.Sum(buf[:size])
+				copy(hashes[index*sha1.Size:], hash[:])
+			}
+		}()
+	}
+
+	for index := 0; index < numPieces; index++ {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return hashes, nil
+}
@@ -0,0 +1,51 @@
+package torrentfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateSymlinkedRoot(t *testing.T) {
+	dir := t.TempDir()
+	content := filepath.Join(dir, "content")
+	err := os.MkdirAll(filepath.Join(content, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", filepath.Join("sub", "b")} {
+		err = os.WriteFile(filepath.Join(content, name), []byte("data of "+name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "link")
+	err = os.Symlink(content, link)
+	if err != nil {
+		t.Skip("no symlinks here:", err)
+	}
+
+	buf, err := Create(link, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// named after the link, holding what it points to
+	if tf.Name != "link" {
+		t.Errorf("torrent is named %q, want link", tf.Name)
+	}
+	if len(tf.Files) != 2 {
+		t.Fatalf("torrent has %d files, want 2", len(tf.Files))
+	}
+	want, err := Create(content, CreateOptions{Name: "link"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(want) {
+		t.Error("torrent of the link differs from the torrent of the directory")
+	}
+}
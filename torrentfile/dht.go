@@ -0,0 +1,121 @@
+package torrentfile
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/comms"
+	"github.com/Richd0tcom/bookish-chainsaw/dht"
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// DHTBootstrapNodes are used to join the DHT when looking for peers.
+// Set it to nil to only ask trackers
+var DHTBootstrapNodes = dht.DefaultBootstrapNodes
+
+// DHTAddr is the UDP address our DHT node listens on
+var DHTAddr = ":6881"
+
+// joinDHT starts a DHT node and bootstraps it. The caller closes the node
+func joinDHT() (*dht.Server, error) {
+	node, err := dht.New(dht.Config{Addr: DHTAddr, BootstrapNodes: DHTBootstrapNodes})
+	if err != nil {
+		return nil, err
+	}
+
+	err = node.Bootstrap()
+	if err != nil {
+		node.Close()
+		return nil, err
+	}
+	log.Printf("Joined the DHT with %d nodes\n", node.NumNodes())
+	return node, nil
+}
+
+// findPeers asks the trackers and the DHT for peers at the same time and
+// merges what they return. It only fails if both come back empty handed.
+// The DHT node it announced on is returned even then, nil if it could not
+// join. Keep it open while downloading, other nodes send peers our way
+func (tf *TorrentFile) findPeers(trackers func() ([]peers.Peer, error)) ([]peers.Peer, *dht.Server, error) {
+	type result struct {
+		peers []peers.Peer
+		node  *dht.Server
+		err   error
+	}
+
+	dhtResult := make(chan result, 1)
+	// private torrents only get peers from their trackers (BEP 27)
+	if len(DHTBootstrapNodes) > 0 && !tf.Private {
+		go func() {
+			node, err := joinDHT()
+			if err != nil {
+				dhtResult <- result{err: err}
+				return
+			}
+			ps, err := node.Announce(tf.InfoHash, Port)
+			dhtResult <- result{ps, node, err}
+		}()
+	} else {
+		dhtResult <- result{}
+	}
+
+	trackerPeers, trackerErr := trackers()
+	if trackerErr != nil {
+		log.Printf("Tracker failed: %v\n", trackerErr)
+	}
+
+	res := <-dhtResult
+	if res.err != nil {
+		log.Printf("DHT lookup failed: %v\n", res.err)
+	}
+
+	found := mergePeers(trackerPeers, res.peers)
+	if len(found) == 0 {
+		if trackerErr != nil {
+			return nil, res.node, trackerErr
+		}
+		if res.err != nil {
+			return nil, res.node, res.err
+		}
+		return nil, res.node, fmt.Errorf("no peers found for %x", tf.InfoHash)
+	}
+	return found, res.node, nil
+}
+
+// keepAnnouncingDHT announces again every DHTAnnounceInterval until done is
+// closed, so nodes don't forget us, and hands the peers it finds to torrent
+func (tf *TorrentFile) keepAnnouncingDHT(node *dht.Server, torrent *comms.Torrent, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(DHTAnnounceInterval):
+		}
+
+		ps, err := node.Announce(tf.InfoHash, Port)
+		if isClosed(done) {
+			return // the node was closed under us, nothing worth logging
+		}
+		if err != nil {
+			log.Printf("DHT lookup for %s failed: %v\n", tf.Name, err)
+		}
+		torrent.AddPeers(ps)
+	}
+}
+
+// mergePeers concatenates peer lists, dropping duplicates
+func mergePeers(lists ...[]peers.Peer) []peers.Peer {
+	seen := make(map[string]bool)
+	merged := []peers.Peer{}
+	for _, list := range lists {
+		for _, p := range list {
+			if seen[p.String()] {
+				continue
+			}
+			seen[p.String()] = true
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,105 @@
+package torrentfile
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/dht"
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+func TestFindPeersKeepsDHTNodeOpen(t *testing.T) {
+	seed, err := dht.New(dht.Config{Addr: "127.0.0.1:0", QueryTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seed.Close()
+
+	oldNodes, oldAddr := DHTBootstrapNodes, DHTAddr
+	DHTBootstrapNodes = []string{seed.Addr().String()}
+	DHTAddr = "127.0.0.1:0"
+	defer func() {
+		DHTBootstrapNodes, DHTAddr = oldNodes, oldAddr
+	}()
+
+	tf := TorrentFile{InfoHash: [20]byte{1, 2, 3}}
+	noTrackers := func() ([]peers.Peer, error) {
+		return nil, errors.New("no trackers")
+	}
+
+	// nobody else is on the DHT, so there are no peers yet, but we did announce
+	_, node, err := tf.findPeers(noTrackers)
+	if err == nil {
+		t.Fatal("found peers in an empty swarm")
+	}
+	if node == nil {
+		t.Fatal("no DHT node was returned")
+	}
+	defer node.Close()
+
+	// the node must still answer, otherwise peers can't find us through it
+	id, err := seed.Ping(node.Addr())
+	if err != nil {
+		t.Fatalf("DHT node stopped answering after the lookup: %v", err)
+	}
+	if id != node.ID() {
+		t.Errorf("got ID %x, want %x", id, node.ID())
+	}
+
+	// and the seed remembers our announce for others that come looking
+	other, err := dht.New(dht.Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: DHTBootstrapNodes,
+		QueryTimeout:   500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	err = other.Bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := other.GetPeers(tf.InfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Port != Port {
+		t.Errorf("got peers %v, want us on port %d", ps, Port)
+	}
+}
+
+func TestFindPeersSkipsDHTForPrivateTorrents(t *testing.T) {
+	seed, err := dht.New(dht.Config{Addr: "127.0.0.1:0", QueryTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seed.Close()
+
+	oldNodes, oldAddr := DHTBootstrapNodes, DHTAddr
+	DHTBootstrapNodes = []string{seed.Addr().String()}
+	DHTAddr = "127.0.0.1:0"
+	defer func() {
+		DHTBootstrapNodes, DHTAddr = oldNodes, oldAddr
+	}()
+
+	tf := TorrentFile{InfoHash: [20]byte{1, 2, 3}, Private: true}
+	tracker := []peers.Peer{{IP: []byte{10, 0, 0, 1}, Port: 6881}}
+	found, node, err := tf.findPeers(func() ([]peers.Peer, error) {
+		return tracker, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != nil {
+		node.Close()
+		t.Error("joined the DHT for a private torrent")
+	}
+	if len(found) != 1 {
+		t.Errorf("got peers %v, want only the tracker's", found)
+	}
+	if seed.NumNodes() != 0 {
+		t.Errorf("the bootstrap node heard from %d nodes, want none", seed.NumNodes())
+	}
+}
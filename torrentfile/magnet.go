@@ -0,0 +1,102 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+
+	"github.com/Richd0tcom/bookish-chainsaw/dht"
+	"github.com/Richd0tcom/bookish-chainsaw/magnet"
+	"github.com/Richd0tcom/bookish-chainsaw/metadata"
+)
+
+// OpenMagnet resolves a magnet URI into a TorrentFile by fetching the
+// info dictionary from the swarm
+func OpenMagnet(uri string) (TorrentFile, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	var node *dht.Server
+	if len(DHTBootstrapNodes) > 0 {
+		// peers we find may look us up again while we fetch the metadata, so stay on until then
+		node, err = joinDHT()
+		if err != nil {
+			log.Printf("Could not join the DHT: %v\n", err)
+			node = nil
+		} else {
+			defer node.Close()
+		}
+	}
+	return fetchMagnet(m, node, Port)
+}
+
+// FetchMagnet resolves a parsed magnet like OpenMagnet, but looks for peers
+// through the session's DHT node instead of starting one of its own. It can
+// run while the session's torrents do
+func (s *Session) FetchMagnet(m magnet.Magnet) (TorrentFile, error) {
+	return fetchMagnet(m, s.node, s.port)
+}
+
+// fetchMagnet finds peers for m through its trackers and node, which may be
+// nil, and fetches the info dictionary from them. port is announced as ours
+func fetchMagnet(m magnet.Magnet, node *dht.Server, port uint16) (TorrentFile, error) {
+	var peerID [20]byte
+	_, err := rand.Read(peerID[:])
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	ps := m.Peers
+	if len(m.Trackers) > 0 {
+		// we don't know the length yet, so the trackers see left=0
+		partial := TorrentFile{InfoHash: m.InfoHash, AnnounceList: magnetTiers(m)}
+		found, err := partial.announceTiers(context.Background(), announceRequest{PeerID: peerID, Port: port})
+		if err != nil {
+			log.Printf("Trackers failed: %v\n", err)
+		}
+		ps = mergePeers(ps, found)
+	}
+	if node != nil {
+		found, err := node.Announce(m.InfoHash, port)
+		if err != nil {
+			log.Printf("DHT lookup failed: %v\n", err)
+		}
+		ps = mergePeers(ps, found)
+	}
+	if len(ps) == 0 {
+		return TorrentFile{}, fmt.Errorf("no peers found for magnet %x", m.InfoHash)
+	}
+
+	rawInfo, err := metadata.Fetch(ps, m.InfoHash, peerID)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	return parseMagnetInfo(m, rawInfo)
+}
+
+func parseMagnetInfo(m magnet.Magnet, rawInfo []byte) (TorrentFile, error) {
+	bto := bencodeTorrent{RawInfo: rawInfo}
+	if len(m.Trackers) > 0 {
+		bto.Announce = m.Trackers[0]
+	}
+
+	tf, err := bto.parseToTorrentFile()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	tf.AnnounceList = magnetTiers(m)
+	return tf, nil
+}
+
+// every tracker of a magnet gets its own tier so all of them are asked
+func magnetTiers(m magnet.Magnet) [][]string {
+	tiers := [][]string{}
+	for _, tr := range m.Trackers {
+		tiers = append(tiers, []string{tr})
+	}
+	return tiers
+}
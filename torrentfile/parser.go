@@ -1,12 +1,14 @@
 package torrentfile
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"os"
+	"sort"
+	"time"
 
-	"github.com/jackpal/bencode-go"
+	"github.com/Richd0tcom/bookish-chainsaw/bencode"
+	"github.com/Richd0tcom/bookish-chainsaw/files"
 )
 
 type bencodeInfo struct {
@@ -14,34 +16,65 @@ type bencodeInfo struct {
 	Pieces      string `bencode:"pieces"` 
 
     PieceLength int    `bencode:"piece length"`
-    Length      int    `bencode:"length"`
+    Length      int    `bencode:"length,omitempty"` //single-file torrents only
+    Files       []bencodeFile `bencode:"files,omitempty"` //multi-file torrents only
     Name        string `bencode:"name"`
+	Private     int    `bencode:"private,omitempty"` //1 keeps peers to the trackers (BEP 27)
 }
 
-type bencodeTorrent struct {
-	Announce string `bencode:"announce"`
-	Info bencodeInfo `bencode:"info"`
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
 
+type bencodeTorrent struct {
+	Announce string `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"` //tiers of backup trackers (BEP 12)
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"` //unix time
+	//web seeds (BEP 19), a single URL or a list of them
+	URLList bencode.RawMessage `bencode:"url-list,omitempty"`
+	//the info dictionary exactly as it is in the torrent. Decoding and encoding it
+	//again would drop keys we don't know about and change the infohash
+	RawInfo bencode.RawMessage `bencode:"info"`
 }
 
 //parses a bencoded torrent file
 func OpenFile(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer file.Close()
+	return Parse(data)
+}
 
+// Parse parses the contents of a .torrent file
+func Parse(data []byte) (TorrentFile, error) {
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err := bencode.Unmarshal(data, &bto)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	return bto.parseToTorrentFile()
+	tf, err := bto.parseToTorrentFile()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	unknown, err := unknownKeys(data, torrentKeys, "")
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	tf.UnknownKeys = append(unknown, tf.UnknownKeys...)
+	return tf, nil
 }
 
 type TorrentFile struct {
     Announce    string
+
+	//tiers of trackers. Each tier is shuffled once when the torrent is parsed.
+	//falls back to a single tier holding Announce when the torrent has no announce-list
+	AnnounceList [][]string
 	//SHA-1 hash of the file (helps us know we're getting the right file)
     InfoHash    [20]byte
 
@@ -52,24 +85,29 @@ type TorrentFile struct {
 	//total length of the bytes of the file 
     Length      int
     Name        string
-}
 
-const Port uint16 = 1738
+	//files of the torrent. Single-file torrents have one file with an empty path
+	Files       files.Table
 
-// returns the SHA-1 hash of the info that identifies the file
-func (bi *bencodeInfo) hashInfo() ([20]byte, error){
-	buffer:= bytes.Buffer{}
+	//the bencoded info dictionary exactly as it was in the torrent. InfoHash is its SHA-1
+	RawInfo []byte
 
-	err:= bencode.Marshal(&buffer, *bi)
+	//private torrents only get peers from their trackers (BEP 27)
+	Private bool
 
-	if err != nil {
-		return [20]byte{}, err
-	}
-	
-	hash:= sha1.Sum(buffer.Bytes())
+	//optional metadata. CreationDate is zero when the torrent doesn't have one
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+
+	//HTTP servers holding the torrent's files (BEP 19)
+	WebSeeds []string
+
+	//keys of the torrent we don't use, sorted. Keys of the info dictionary start with "info."
+	UnknownKeys []string
+}
 
-	return hash, nil
-} 
+const Port uint16 = 1738
 
 func (bi *bencodeInfo) splitPieceHash() ([][20]byte, error) {
 	pieces:= []byte(bi.Pieces)
@@ -91,33 +129,172 @@ func (bi *bencodeInfo) splitPieceHash() ([][20]byte, error) {
 
 }
 
+// checkPieces makes sure the pieces cover the data exactly. Everything that
+// splits the data into pieces trusts that
+func (tf *TorrentFile) checkPieces() error {
+	if tf.PieceLength <= 0 {
+		return fmt.Errorf("torrent has invalid piece length %d", tf.PieceLength)
+	}
+	numPieces := (tf.Length + tf.PieceLength - 1) / tf.PieceLength
+	if len(tf.PieceHashes) != numPieces {
+		return fmt.Errorf("torrent has %d piece hashes but its %d bytes need %d", len(tf.PieceHashes), tf.Length, numPieces)
+	}
+	return nil
+}
+
+// builds the file table. Paths are sanitized so they stay inside the download directory
+func (bi *bencodeInfo) buildFileTable() (files.Table, error) {
+	if len(bi.Files) == 0 {
+		if bi.Length <= 0 {
+			return nil, fmt.Errorf("torrent has neither a length nor files")
+		}
+		return files.NewTable([]files.File{{Length: bi.Length}}), nil
+	}
+
+	fs := make([]files.File, len(bi.Files))
+	for i, f := range bi.Files {
+		if f.Length < 0 {
+			return nil, fmt.Errorf("file %d has negative length %d", i, f.Length)
+		}
+		path, err := files.SanitizePath(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		fs[i] = files.File{Path: path, Length: f.Length}
+	}
+	return files.NewTable(fs), nil
+}
+
 func (bto bencodeTorrent) parseToTorrentFile() (TorrentFile, error) {
+	if len(bto.RawInfo) == 0 {
+		return TorrentFile{}, fmt.Errorf("torrent has no info dictionary")
+	}
+	info := bencodeInfo{}
+	err := bencode.Unmarshal(bto.RawInfo, &info)
+	if err != nil {
+		return TorrentFile{}, err
+	}
 
-	pieceHashes, err:= bto.Info.splitPieceHash()
+	pieceHashes, err:= info.splitPieceHash()
 
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
-	infoHash, err := bto.Info.hashInfo()
+	infoHash := sha1.Sum(bto.RawInfo)
 
+	fileTable, err := info.buildFileTable()
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	
 	torrentfile:= TorrentFile{
 		Announce: bto.Announce,
+		AnnounceList: buildTiers(bto.Announce, bto.AnnounceList),
 		InfoHash: infoHash,
 		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length: bto.Info.Length,
-		Name: bto.Info.Name,
+		PieceLength: info.PieceLength,
+		Length: fileTable.Length(),
+		Name: info.Name,
+		Files: fileTable,
+		RawInfo: bto.RawInfo,
+		Private: info.Private == 1,
+		Comment: bto.Comment,
+		CreatedBy: bto.CreatedBy,
+		WebSeeds: bto.webSeeds(),
+	}
+	if bto.CreationDate > 0 {
+		torrentfile.CreationDate = time.Unix(bto.CreationDate, 0)
+	}
+	err = torrentfile.checkPieces()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	torrentfile.UnknownKeys, err = unknownKeys(bto.RawInfo, infoKeys, "info.")
+	if err != nil {
+		return TorrentFile{}, err
 	}
 
 	return torrentfile, nil
 }
 
+// webSeeds accepts url-list as a list or a single URL. Anything else is ignored
+func (bto bencodeTorrent) webSeeds() []string {
+	if len(bto.URLList) == 0 {
+		return nil
+	}
+	var list []string
+	if bencode.Unmarshal(bto.URLList, &list) == nil {
+		return list
+	}
+	var single string
+	if bencode.Unmarshal(bto.URLList, &single) == nil && single != "" {
+		return []string{single}
+	}
+	return nil
+}
 
+// keys of bencodeTorrent and bencodeInfo
+var (
+	torrentKeys = []string{"announce", "announce-list", "comment", "created by", "creation date", "info", "url-list"}
+	infoKeys    = []string{"files", "length", "name", "piece length", "pieces", "private"}
+)
 
+// unknownKeys returns the keys of the dictionary in data that aren't in known, with prefix added
+func unknownKeys(data []byte, known []string, prefix string) ([]string, error) {
+	dict := map[string]bencode.RawMessage{}
+	err := bencode.Unmarshal(data, &dict)
+	if err != nil {
+		return nil, err
+	}
+
+	unknown := []string{}
+	for key := range dict {
+		isKnown := false
+		for _, k := range known {
+			if k == key {
+				isKnown = true
+				break
+			}
+		}
+		if !isKnown {
+			unknown = append(unknown, prefix+key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
 
+// Marshal encodes the torrent as a .torrent file. The info dictionary is written
+// exactly as it was read, so the infohash stays the same. Keys outside of it
+// that we don't know about are lost
+func (tf *TorrentFile) Marshal() ([]byte, error) {
+	if len(tf.RawInfo) == 0 {
+		return nil, fmt.Errorf("torrent %x has no info dictionary", tf.InfoHash)
+	}
 
+	bto := bencodeTorrent{
+		Announce:  tf.Announce,
+		Comment:   tf.Comment,
+		CreatedBy: tf.CreatedBy,
+		RawInfo:   tf.RawInfo,
+	}
+	tiers := tf.tiers()
+	if bto.Announce == "" && len(tiers) > 0 {
+		bto.Announce = tiers[0][0]
+	}
+	if len(tiers) > 1 || (len(tiers) == 1 && len(tiers[0]) > 1) {
+		bto.AnnounceList = tiers
+	}
+	if !tf.CreationDate.IsZero() {
+		bto.CreationDate = tf.CreationDate.Unix()
+	}
+	if len(tf.WebSeeds) > 0 {
+		var err error
+		bto.URLList, err = bencode.Marshal(tf.WebSeeds)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bencode.Marshal(bto)
+}
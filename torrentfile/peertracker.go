@@ -1,28 +1,99 @@
 package torrentfile
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
-	
+	"io"
+	"log"
+	"net"
 	"net/url"
-	"os"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/Richd0tcom/bookish-chainsaw/bencode"
 	"github.com/Richd0tcom/bookish-chainsaw/comms"
 	"github.com/Richd0tcom/bookish-chainsaw/peers"
-	"github.com/jackpal/bencode-go"
+	"github.com/Richd0tcom/bookish-chainsaw/storage"
 
 	"net/http"
 )
 
 type trackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  string `bencode:"failure reason"`
+	WarningMessage string `bencode:"warning message"`
+	Interval       int    `bencode:"interval"`
+	MinInterval    int    `bencode:"min interval"`
+	TrackerID      string `bencode:"tracker id"`
+	Complete       int    `bencode:"complete"`
+	Incomplete     int    `bencode:"incomplete"`
+
+	//a compact string or a list of dictionaries, see decodePeers
+	Peers  bencode.RawMessage `bencode:"peers"`
+	Peers6 string             `bencode:"peers6"`
+}
+
+// TrackerError is returned when a tracker refuses an announce
+type TrackerError struct {
+	Tracker string
+	//the failure reason the tracker sent
+	Reason string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker %s refused announce: %s", e.Tracker, e.Reason)
+}
+
+// trackers hand out a tracker id we have to send back on later announces
+var (
+	trackerIDsMu sync.Mutex
+	trackerIDs   = make(map[trackerKey]string)
+)
+
+type trackerKey struct {
+	announce string
+	infoHash [20]byte
+}
+
+// tracker events. The empty event is a regular re-announce
+const (
+	eventNone      = ""
+	eventStarted   = "started"
+	eventCompleted = "completed"
+	eventStopped   = "stopped"
+)
+
+// announceRequest is what we tell a tracker about ourselves
+type announceRequest struct {
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+}
+
+// announceResponse is what a tracker tells us back
+type announceResponse struct {
+	//how long to wait before announcing again. 0 if the tracker didn't say
+	Interval time.Duration
+	//we must not announce more often than this
+	MinInterval time.Duration
+	//seeders and leechers in the swarm, -1 if the tracker didn't say
+	Seeders  int
+	Leechers int
+	Peers    []peers.Peer
+}
+
+// request builds an announce for a download that hasn't started
+func (tf *TorrentFile) request(peerID [20]byte) announceRequest {
+	return announceRequest{PeerID: peerID, Port: Port, Left: int64(tf.Length)}
 }
 
 //builds the tracker URL so we can connect the tracker and search for peers
-func (tf *TorrentFile) buildTrackerURL(port uint16, peerID [20]byte) (string, error) {
-	baseURL, err :=url.Parse(tf.Announce)
+func (tf *TorrentFile) buildTrackerURL(announce string, req announceRequest) (string, error) {
+	baseURL, err :=url.Parse(announce)
 
 	if err != nil {
 		return "", err
@@ -30,12 +101,22 @@ func (tf *TorrentFile) buildTrackerURL(port uint16, peerID [20]byte) (string, er
 
 	params := url.Values{
         "info_hash":  []string{string(tf.InfoHash[:])},
-        "peer_id":    []string{string(peerID[:])},
-        "port":       []string{strconv.Itoa(int(port))},
-        "uploaded":   []string{"0"},
-        "downloaded": []string{"0"},
+        "peer_id":    []string{string(req.PeerID[:])},
+        "port":       []string{strconv.Itoa(int(req.Port))},
+        "uploaded":   []string{strconv.FormatInt(req.Uploaded, 10)},
+        "downloaded": []string{strconv.FormatInt(req.Downloaded, 10)},
         "compact":    []string{"1"},
-        "left":       []string{strconv.Itoa(tf.Length)},
+        "left":       []string{strconv.FormatInt(req.Left, 10)},
+    }
+    if req.Event != eventNone {
+        params.Set("event", req.Event)
+    }
+
+    trackerIDsMu.Lock()
+    trackerID := trackerIDs[trackerKey{announce, tf.InfoHash}]
+    trackerIDsMu.Unlock()
+    if trackerID != "" {
+        params.Set("trackerid", trackerID)
     }
 
 	baseURL.RawQuery = params.Encode()
@@ -43,75 +124,284 @@ func (tf *TorrentFile) buildTrackerURL(port uint16, peerID [20]byte) (string, er
 }
 
 
+// ConnectToPeers announces to the tiers in order and returns the peers of every tier that answers
 func (tf *TorrentFile) ConnectToPeers(peerID [20]byte) ([]peers.Peer, error) {
+	return tf.announceTiers(context.Background(), tf.request(peerID))
+}
 
-	url, err:= tf.buildTrackerURL(Port, peerID)
+// announce announces to a single tracker. The tracker protocol is picked
+// from the scheme of the announce URL. Cancelling ctx gives up on the tracker
+func (tf *TorrentFile) announce(ctx context.Context, announce string, req announceRequest) (*announceResponse, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
 
+	switch u.Scheme {
+	case "http", "https":
+		return tf.announceHTTP(ctx, announce, req)
+	case "udp":
+		return tf.announceUDP(ctx, u.Host, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
 
-	c:= http.Client{}
+func (tf *TorrentFile) announceHTTP(ctx context.Context, announce string, req announceRequest) (*announceResponse, error) {
 
-	response, err:= c.Get(url)
+	url, err:= tf.buildTrackerURL(announce, req)
 	if err != nil {
-		fmt.Println(err)
-		return []peers.Peer{}, err
+		return nil, err
 	}
 
-	defer response.Body.Close()
+	c:= http.Client{Timeout: 15 * time.Second}
 
-	trackRes:= trackerResp{}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err:= c.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
 
-	err = bencode.Unmarshal(response.Body, &trackRes)
+	defer response.Body.Close()
 
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxTrackerResponse))
 	if err != nil {
-		fmt.Println(err)
-		return []peers.Peer{}, err
+		return nil, err
 	}
 
-	fmt.Println(trackRes)
+	// counts the tracker leaves out stay at -1
+	trackRes:= trackerResp{Complete: -1, Incomplete: -1}
 
-	return peers.ParsePeers([]byte(trackRes.Peers))
+	err = bencode.Unmarshal(body, &trackRes)
 
+	if err != nil {
+		return nil, fmt.Errorf("could not decode response from tracker %s (HTTP %s): %w", announce, response.Status, err)
+	}
 
-	//we will update the function to return Peers instead
+	// a failure reason means nothing else in the response can be trusted
+	if trackRes.FailureReason != "" {
+		return nil, &TrackerError{Tracker: announce, Reason: trackRes.FailureReason}
+	}
+	if trackRes.WarningMessage != "" {
+		log.Printf("Tracker %s warns: %s\n", announce, trackRes.WarningMessage)
+	}
+	if trackRes.TrackerID != "" {
+		trackerIDsMu.Lock()
+		trackerIDs[trackerKey{announce, tf.InfoHash}] = trackRes.TrackerID
+		trackerIDsMu.Unlock()
+	}
 
-	
+	ps, err := trackRes.decodePeers()
+	if err != nil {
+		return nil, err
+	}
+	return &announceResponse{
+		Interval:    time.Duration(trackRes.Interval) * time.Second,
+		MinInterval: time.Duration(trackRes.MinInterval) * time.Second,
+		Seeders:     trackRes.Complete,
+		Leechers:    trackRes.Incomplete,
+		Peers:       ps,
+	}, nil
 }
 
-// DownloadToFile downloads a torrent and writes it to a file
+// SeedRatio is how many times the torrent's length we upload after the download
+// completes before stopping. 0 disables seeding
+var SeedRatio = 1.0
+
+// SeedTime is the longest we keep seeding after the download completes
+var SeedTime = 30 * time.Minute
+
+// DownloadToFile downloads a torrent and writes it to a file, then seeds it
+// until SeedRatio or SeedTime is reached
 func (t *TorrentFile) DownloadToFile(path string) error {
+	// single-file torrents are written to path, multi-file torrents below it
+	return t.download(storage.NewFile(path), path)
+}
+
+// DownloadTo downloads a torrent into st, then seeds it like DownloadToFile.
+// Pieces already in st are hash checked and not downloaded again
+func (t *TorrentFile) DownloadTo(st storage.Storage) error {
+	return t.download(st, "")
+}
+
+// StorageInfo returns the layout storage needs to hold the torrent
+func (t *TorrentFile) StorageInfo() *storage.Info {
+	return &storage.Info{
+		InfoHash:    t.InfoHash,
+		Name:        t.Name,
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Files:       t.Files,
+	}
+}
+
+// download keeps a resume file next to path. Without a path it hash checks st instead
+func (t *TorrentFile) download(st storage.Storage, path string) error {
 	var peerID [20]byte
 	_, err := rand.Read(peerID[:])
 	if err != nil {
 		return err
 	}
 
-	peers, err := t.ConnectToPeers(peerID)
+	data, err := st.OpenTorrent(t.StorageInfo())
 	if err != nil {
 		return err
 	}
+	defer data.Close()
 
 	torrent := comms.Torrent{
-		Peers:       peers,
 		PeerID:      peerID,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		Storage:     data,
+		RawInfo:     t.RawInfo,
+		Private:     t.Private,
 	}
-	buf, err := torrent.Download()
-	if err != nil {
+	defer torrent.Close()
+
+	// pick up where an interrupted download left off
+	t.resume(path, &torrent)
+	seeding := torrent.Left() == 0
+	if seeding && SeedRatio <= 0 {
+		// nothing to download and nothing to seed, so no need for peers either
+		log.Printf("%s is already complete\n", t.Name)
+		return nil
+	}
+
+	trackers := newAnnouncer(t, &torrent, peerID, Port)
+	defer trackers.close()
+
+	ps, node, err := t.findPeers(trackers.start)
+	if node != nil {
+		defer node.Close()
+	}
+	if err != nil && !seeding {
 		return err
 	}
+	if err != nil {
+		// a seed can wait for peers that find us on their own
+		log.Printf("Could not find peers, seeding anyway: %v\n", err)
+	}
+	torrent.Peers = ps
 
-	outFile, err := os.Create(path)
+	// peers that got our address from the tracker connect to us here
+	server, err := comms.Listen(Port)
 	if err != nil {
-		return err
+		log.Printf("Could not listen on port %d, not uploading: %v\n", Port, err)
+	} else {
+		defer server.Close()
+		torrent.ListenPort = Port
+		server.Add(&torrent)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if node != nil {
+		go t.keepAnnouncingDHT(node, &torrent, done)
+	}
+	if path != "" {
+		go t.keepResumeSaved(path, &torrent, done)
+	}
+
+	err = torrent.Download()
+	if path != "" {
+		saveErr := t.saveResume(path, torrent.Bitfield())
+		if saveErr != nil {
+			log.Println("Could not save resume file:", saveErr)
+		}
 	}
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
 	if err != nil {
 		return err
 	}
+	if !seeding {
+		trackers.complete()
+	}
+
+	if server != nil && SeedRatio > 0 {
+		log.Printf("Download complete, seeding for up to %s\n", SeedTime)
+		torrent.Seed(SeedRatio, SeedTime)
+		log.Printf("Stopped seeding after uploading %d bytes\n", torrent.Uploaded())
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// trackers rarely send more than a few KB, anything this big is not a tracker response
+const maxTrackerResponse = 4 * 1024 * 1024
+
+// peers of the dictionary model may be host names. Only this many of a response
+// are looked up, and all lookups share peerLookupTimeout. The rest are dropped
+const (
+	maxPeerLookups    = 10
+	peerLookupTimeout = 5 * time.Second
+)
+
+// a peer of the dictionary model
+type dictPeer struct {
+	IP   string `bencode:"ip"`
+	Port int    `bencode:"port"`
+}
+
+// decodePeers collects the IPv4 and IPv6 peers of a response. peers is either
+// a compact string or, from trackers that ignore compact=1, a list of
+// dictionaries with ip and port keys
+func (resp *trackerResp) decodePeers() ([]peers.Peer, error) {
+	found := []peers.Peer{}
+	if len(resp.Peers) > 0 {
+		var compact []byte
+		var list []dictPeer
+		if err := bencode.Unmarshal(resp.Peers, &compact); err == nil {
+			ps, err := peers.ParsePeers(compact)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, ps...)
+		} else if err := bencode.Unmarshal(resp.Peers, &list); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), peerLookupTimeout)
+			defer cancel()
+			lookups := maxPeerLookups
+			for _, entry := range list {
+				peer, ok := entry.resolve(ctx, &lookups)
+				if ok {
+					found = append(found, peer)
+				}
+			}
+		} else {
+			return nil, fmt.Errorf("tracker sent peers in an unexpected form: %w", err)
+		}
+	}
+
+	ps, err := peers.ParsePeers6([]byte(resp.Peers6))
+	if err != nil {
+		return nil, err
+	}
+	return append(found, ps...), nil
+}
+
+// resolve turns the peer into an address. The ip key may also hold a host
+// name, which is looked up if lookups are left and ctx allows
+func (d dictPeer) resolve(ctx context.Context, lookups *int) (peers.Peer, bool) {
+	host, port := d.IP, d.Port
+	if host == "" || port <= 0 || port > 65535 {
+		return peers.Peer{}, false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if *lookups <= 0 {
+			return peers.Peer{}, false
+		}
+		*lookups--
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil || len(ips) == 0 {
+			return peers.Peer{}, false
+		}
+		ip = ips[0]
+	}
+	return peers.Peer{IP: ip, Port: uint16(port)}, true
+}
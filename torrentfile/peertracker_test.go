@@ -0,0 +1,39 @@
+package torrentfile
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bencode"
+)
+
+func TestDecodeDictPeersCapsLookups(t *testing.T) {
+	list := []dictPeer{{IP: "10.0.0.1", Port: 6881}}
+	for i := 0; i < maxPeerLookups+5; i++ {
+		list = append(list, dictPeer{IP: "localhost", Port: 7000 + i})
+	}
+	list = append(list, dictPeer{IP: "10.0.0.2", Port: 6881}, dictPeer{IP: "10.0.0.3", Port: 0})
+
+	raw, err := bencode.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := trackerResp{Peers: raw}
+	ps, err := resp.decodePeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both addresses, only maxPeerLookups of the host names and never a peer without a port
+	if len(ps) != maxPeerLookups+2 {
+		t.Fatalf("got %d peers, want %d", len(ps), maxPeerLookups+2)
+	}
+	if !ps[0].IP.Equal(net.IPv4(10, 0, 0, 1)) || !ps[len(ps)-1].IP.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("got peers %v, want the addresses first and last", ps)
+	}
+	for _, p := range ps[1 : len(ps)-1] {
+		if !p.IP.IsLoopback() {
+			t.Errorf("localhost resolved to %s", p.IP)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bitfield"
+	"github.com/Richd0tcom/bookish-chainsaw/comms"
+)
+
+// ResumeInterval is how often the resume file is saved while downloading
+var ResumeInterval = 30 * time.Second
+
+// resumeData is what we know about a partial download. The bitfield is only
+// trusted while every file still has the size and modification time it had
+// when it was saved, otherwise the output is hash checked again
+type resumeData struct {
+	InfoHash string       `json:"info_hash"`
+	Bitfield []byte       `json:"bitfield"`
+	Files    []resumeFile `json:"files"`
+}
+
+type resumeFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// the resume file sits next to the output so it works for files and directories alike
+func resumePath(path string) string {
+	return path + ".resume"
+}
+
+func (tf *TorrentFile) statFiles(path string) ([]resumeFile, error) {
+	stats := make([]resumeFile, len(tf.Files))
+	for i, f := range tf.Files {
+		local := f.LocalPath(path)
+		info, err := os.Stat(local)
+		if err != nil {
+			return nil, err
+		}
+		stats[i] = resumeFile{Path: local, Size: info.Size(), ModTime: info.ModTime()}
+	}
+	return stats, nil
+}
+
+// loadResume returns the pieces a previous run saved as done. ok is false when
+// there is no resume file or the files changed since it was written
+func (tf *TorrentFile) loadResume(path string) (bf bitfield.Bitfield, ok bool) {
+	buf, err := os.ReadFile(resumePath(path))
+	if err != nil {
+		return nil, false
+	}
+
+	var rd resumeData
+	err = json.Unmarshal(buf, &rd)
+	if err != nil || rd.InfoHash != hex.EncodeToString(tf.InfoHash[:]) {
+		return nil, false
+	}
+	if len(rd.Bitfield) != (len(tf.PieceHashes)+7)/8 {
+		return nil, false
+	}
+
+	stats, err := tf.statFiles(path)
+	if err != nil || len(stats) != len(rd.Files) {
+		return nil, false
+	}
+	for i, s := range stats {
+		saved := rd.Files[i]
+		if s.Path != saved.Path || s.Size != saved.Size || !s.ModTime.Equal(saved.ModTime) {
+			return nil, false
+		}
+	}
+	return rd.Bitfield, true
+}
+
+// saveResume records the pieces we have. The bitfield is taken before the files
+// are stat'ed, so a piece written in between is downloaded again rather than trusted
+func (tf *TorrentFile) saveResume(path string, bf bitfield.Bitfield) error {
+	stats, err := tf.statFiles(path)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(resumeData{
+		InfoHash: hex.EncodeToString(tf.InfoHash[:]),
+		Bitfield: bf,
+		Files:    stats,
+	})
+	if err != nil {
+		return err
+	}
+
+	// write then rename, so a crash never leaves half a resume file behind
+	tmp := resumePath(path) + ".tmp"
+	err = os.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, resumePath(path))
+}
+
+// resume marks the pieces already in the output as done, from the resume file
+// if it is still valid and by hash checking the output otherwise. An empty
+// path means there is no resume file
+func (tf *TorrentFile) resume(path string, torrent *comms.Torrent) {
+	if path != "" {
+		bf, ok := tf.loadResume(path)
+		if ok {
+			torrent.MarkHave(bf)
+			log.Printf("Resuming with %d of %d pieces\n", countPieces(bf, len(tf.PieceHashes)), len(tf.PieceHashes))
+			return
+		}
+	}
+
+	good := torrent.Check()
+	if good > 0 {
+		log.Printf("Found %d of %d pieces in storage\n", good, len(tf.PieceHashes))
+	}
+}
+
+// keepResumeSaved saves the resume file every ResumeInterval until done is closed
+func (tf *TorrentFile) keepResumeSaved(path string, torrent *comms.Torrent, done <-chan struct{}) {
+	ticker := time.NewTicker(ResumeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		err := tf.saveResume(path, torrent.Bitfield())
+		if err != nil {
+			log.Println("Could not save resume file:", err)
+		}
+	}
+}
+
+func countPieces(bf bitfield.Bitfield, numPieces int) int {
+	count := 0
+	for i := 0; i < numPieces; i++ {
+		if bf.HasPiece(i) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,144 @@
+package torrentfile
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bencode"
+)
+
+// ScrapeURL derives the scrape URL of an HTTP tracker from its announce URL.
+// By convention the last path component has to start with "announce", and
+// that part is replaced with "scrape". Other trackers don't support scraping
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+
+	dir, last := path.Split(u.Path)
+	if !strings.HasPrefix(last, "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announce)
+	}
+	u.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	return u.String(), nil
+}
+
+// Scrape asks a tracker for swarm statistics of each infohash without
+// announcing. Torrents the tracker doesn't know about are left out
+func Scrape(tracker string, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(tracker, infoHashes)
+	case "udp":
+		results, err := scrapeUDP(u.Host, infoHashes)
+		if err != nil {
+			return nil, err
+		}
+		// udp trackers answer for every infohash, with zeros for unknown ones
+		byHash := make(map[[20]byte]ScrapeResult, len(results))
+		for i, res := range results {
+			byHash[infoHashes[i]] = res
+		}
+		return byHash, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+func scrapeHTTP(announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrape, err := ScrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(scrape)
+	if err != nil {
+		return nil, err
+	}
+
+	params := u.Query()
+	for _, ih := range infoHashes {
+		params.Add("info_hash", string(ih[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	c := http.Client{Timeout: 15 * time.Second}
+	response, err := c.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxTrackerResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := scrapeResp{}
+	err = bencode.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode scrape response from tracker %s (HTTP %s): %w", scrape, response.Status, err)
+	}
+	if resp.FailureReason != "" {
+		return nil, &TrackerError{Tracker: scrape, Reason: resp.FailureReason}
+	}
+
+	results := make(map[[20]byte]ScrapeResult)
+	for key, f := range resp.Files {
+		if len(key) != 20 {
+			continue
+		}
+		var ih [20]byte
+		copy(ih[:], key)
+		results[ih] = ScrapeResult{
+			Seeders:   f.Complete,
+			Completed: f.Downloaded,
+			Leechers:  f.Incomplete,
+		}
+	}
+	return results, nil
+}
+
+type scrapeResp struct {
+	FailureReason string `bencode:"failure reason"`
+	//keyed by raw infohash
+	Files map[string]scrapeFile `bencode:"files"`
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// Scrape asks the torrent's trackers for its swarm statistics, tier by tier,
+// until one of them answers. It returns the tracker that answered
+func (tf *TorrentFile) Scrape() (ScrapeResult, string, error) {
+	err := fmt.Errorf("torrent has no trackers")
+	for _, tier := range tf.tiers() {
+		for _, tr := range tier {
+			var results map[[20]byte]ScrapeResult
+			results, err = Scrape(tr, tf.InfoHash)
+			if err != nil {
+				continue
+			}
+			res, ok := results[tf.InfoHash]
+			if !ok {
+				err = fmt.Errorf("tracker %s does not know torrent %x", tr, tf.InfoHash)
+				continue
+			}
+			return res, tr, nil
+		}
+	}
+	return ScrapeResult{}, "", err
+}
@@ -0,0 +1,245 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/comms"
+	"github.com/Richd0tcom/bookish-chainsaw/dht"
+)
+
+// DHTAnnounceInterval is how often a session tells the DHT about each torrent.
+// Nodes forget peers after 30 minutes
+var DHTAnnounceInterval = 15 * time.Minute
+
+// SessionConfig configures a Session. The zero value listens on Port without
+// a DHT node or any limits
+type SessionConfig struct {
+	//TCP port peers connect to. Defaults to Port
+	Port uint16
+
+	//UDP address of the DHT node, e.g. ":6881". Empty disables the DHT. The
+	//node joins through DHTBootstrapNodes
+	DHTAddr string
+
+	//bytes per second across all torrents. 0 means unlimited
+	DownloadRate int64
+	UploadRate   int64
+
+	//peer connections across all torrents. 0 means unlimited. Each torrent
+	//also stays below comms.MaxConns
+	MaxConns int
+}
+
+// Session runs many torrents in one process. They share a listener, a peer ID,
+// a DHT node, rate limits and a connection limit
+type Session struct {
+	port   uint16
+	peerID [20]byte
+	server *comms.Server
+	node   *dht.Server //nil without a DHT
+
+	downloadLimit *comms.RateLimiter
+	uploadLimit   *comms.RateLimiter
+	connLimit     *comms.ConnLimit
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	closed   bool
+}
+
+// NewSession starts listening for peers and, if configured, joins the DHT
+func NewSession(cfg SessionConfig) (*Session, error) {
+	s := &Session{
+		port:          cfg.Port,
+		downloadLimit: comms.NewRateLimiter(cfg.DownloadRate),
+		uploadLimit:   comms.NewRateLimiter(cfg.UploadRate),
+		connLimit:     comms.NewConnLimit(cfg.MaxConns),
+		torrents:      make(map[[20]byte]*Torrent),
+	}
+	if s.port == 0 {
+		s.port = Port
+	}
+	_, err := rand.Read(s.peerID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	s.server, err = comms.Listen(s.port)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.DHTAddr != "" && len(DHTBootstrapNodes) > 0 {
+		node, err := dht.New(dht.Config{Addr: cfg.DHTAddr, BootstrapNodes: DHTBootstrapNodes})
+		if err != nil {
+			log.Printf("Could not start DHT node, only using trackers: %v\n", err)
+		} else {
+			s.node = node
+			go func() {
+				err := node.Bootstrap()
+				if err != nil {
+					log.Printf("Could not join the DHT: %v\n", err)
+					return
+				}
+				log.Printf("Joined the DHT with %d nodes\n", node.NumNodes())
+			}()
+		}
+	}
+	return s, nil
+}
+
+// Add starts downloading a torrent into path, or seeding it if path already
+// holds all of it. Like DownloadToFile, multi-file torrents go below path
+func (s *Session) Add(tf TorrentFile, path string) (*Torrent, error) {
+	return s.add(tf, path, false)
+}
+
+// AddPaused adds a torrent without starting it
+func (s *Session) AddPaused(tf TorrentFile, path string) (*Torrent, error) {
+	return s.add(tf, path, true)
+}
+
+func (s *Session) add(tf TorrentFile, path string, paused bool) (*Torrent, error) {
+	if path == "" {
+		return nil, fmt.Errorf("torrent %x needs a path to download into", tf.InfoHash)
+	}
+	err := tf.checkPieces()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, fmt.Errorf("session is closed")
+	}
+	if _, ok := s.torrents[tf.InfoHash]; ok {
+		return nil, fmt.Errorf("torrent %x was already added", tf.InfoHash)
+	}
+
+	t := &Torrent{session: s, file: &tf, path: path, state: StatePaused, added: time.Now()}
+	s.torrents[tf.InfoHash] = t
+	if !paused {
+		t.Resume()
+	}
+	return t, nil
+}
+
+// Get returns the torrent with the infohash
+func (s *Session) Get(infoHash [20]byte) (*Torrent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.torrents[infoHash]
+	return t, ok
+}
+
+// Torrents returns every torrent in the order they were added
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	list := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		list = append(list, t)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].added.Before(list[j].added)
+	})
+	return list
+}
+
+// Remove stops a torrent and forgets it. With deleteData its files and resume
+// file are deleted too
+func (s *Session) Remove(infoHash [20]byte, deleteData bool) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no torrent %x in session", infoHash)
+	}
+
+	t.Pause()
+	if deleteData {
+		return t.deleteData()
+	}
+	return nil
+}
+
+// SetRateLimits changes the download and upload limits in bytes per second. 0 means unlimited
+func (s *Session) SetRateLimits(download, upload int64) {
+	s.downloadLimit.SetRate(download)
+	s.uploadLimit.SetRate(upload)
+}
+
+// SetMaxConns changes the limit on peer connections across all torrents. 0 means unlimited
+func (s *Session) SetMaxConns(max int) {
+	s.connLimit.SetMax(max)
+}
+
+// SessionStats sums up a session
+type SessionStats struct {
+	Torrents int
+	//peer connections across all torrents
+	Conns int
+
+	//the current limits, 0 means unlimited
+	DownloadRate int64
+	UploadRate   int64
+	MaxConns     int
+
+	//bytes across all torrents since they were added
+	Downloaded int64
+	Uploaded   int64
+}
+
+// Stats returns the session's totals and limits
+func (s *Session) Stats() SessionStats {
+	stats := SessionStats{
+		Conns:        s.connLimit.Open(),
+		DownloadRate: s.downloadLimit.Rate(),
+		UploadRate:   s.uploadLimit.Rate(),
+		MaxConns:     s.connLimit.Max(),
+	}
+	for _, t := range s.Torrents() {
+		ts := t.Stats()
+		stats.Torrents++
+		stats.Downloaded += ts.Downloaded
+		stats.Uploaded += ts.Uploaded
+	}
+	return stats
+}
+
+// Port returns the TCP port peers connect to
+func (s *Session) Port() uint16 {
+	return s.port
+}
+
+// Close stops every torrent, telling their trackers, and stops listening
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, t := range s.Torrents() {
+		wg.Add(1)
+		go func(t *Torrent) {
+			defer wg.Done()
+			t.stop(false)
+		}(t)
+	}
+	wg.Wait()
+
+	if s.node != nil {
+		s.node.Close()
+	}
+	return s.server.Close()
+}
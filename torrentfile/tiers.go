@@ -0,0 +1,175 @@
+package torrentfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// Multitracker metadata extension (BEP 12)
+
+// buildTiers copies announce-list into shuffled tiers. Without an announce-list
+// the announce URL becomes the only tier
+func buildTiers(announce string, announceList [][]string) [][]string {
+	tiers := [][]string{}
+	for _, tier := range announceList {
+		shuffled := []string{}
+		for _, tr := range tier {
+			if tr != "" {
+				shuffled = append(shuffled, tr)
+			}
+		}
+		if len(shuffled) == 0 {
+			continue
+		}
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		tiers = append(tiers, shuffled)
+	}
+
+	if len(tiers) == 0 && announce != "" {
+		tiers = append(tiers, []string{announce})
+	}
+	return tiers
+}
+
+// tiers returns the tracker tiers, even for a TorrentFile that was built by hand with only Announce set
+func (tf *TorrentFile) tiers() [][]string {
+	if len(tf.AnnounceList) == 0 {
+		return buildTiers(tf.Announce, nil)
+	}
+	return tf.AnnounceList
+}
+
+// copyTiers returns tiers that can be reordered without touching tf
+func (tf *TorrentFile) copyTiers() [][]string {
+	tiers := [][]string{}
+	for _, tier := range tf.tiers() {
+		tiers = append(tiers, append([]string{}, tier...))
+	}
+	return tiers
+}
+
+// announceTier tries each tracker of a tier in order until one answers.
+// The tracker that answered is moved to the front of its tier
+func (tf *TorrentFile) announceTier(ctx context.Context, tier []string, req announceRequest) (*announceResponse, error) {
+	var err error
+	for i, tr := range tier {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var resp *announceResponse
+		resp, err = tf.announce(ctx, tr, req)
+		if err != nil {
+			log.Printf("Tracker %s failed: %v\n", tr, err)
+			continue
+		}
+
+		copy(tier[1:i+1], tier[0:i])
+		tier[0] = tr
+		return resp, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("tier has no trackers")
+	}
+	return nil, err
+}
+
+// TierFallbackDelay is how long a tier gets to answer before the next tier is
+// asked as well, and how long we keep waiting for more tiers once one answered
+var TierFallbackDelay = 15 * time.Second
+
+// askTiers calls ask for n tiers in order. ask starts asking a tier and
+// returns a channel that gets its one result. The next tier is asked once the
+// one before it reported or TierFallbackDelay passed, until stop is closed.
+// askTiers returns the peers of every tier that answered, without duplicates,
+// once all of them reported or TierFallbackDelay after the first answer
+func askTiers(n int, ask func(i int) <-chan tierResult, stop <-chan struct{}) ([]peers.Peer, error) {
+	if n == 0 {
+		return nil, fmt.Errorf("torrent has no trackers")
+	}
+
+	// the launcher outlives us, so it must not read the setting later
+	delay := TierFallbackDelay
+
+	// buffered, so tiers still running when we return can finish
+	results := make(chan tierResult, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			reported := make(chan struct{})
+			res := ask(i)
+			go func() {
+				results <- <-res
+				close(reported)
+			}()
+
+			select {
+			case <-reported:
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	found := [][]peers.Peer{}
+	var err error
+	var grace <-chan time.Time
+	for got := 0; got < n; got++ {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				err = res.err
+				continue
+			}
+			found = append(found, res.peers)
+			if grace == nil {
+				grace = time.After(delay)
+			}
+		case <-grace:
+			return mergePeers(found...), nil
+		case <-stop:
+			if len(found) > 0 {
+				return mergePeers(found...), nil
+			}
+			return nil, errAnnouncerClosed
+		}
+	}
+	if len(found) == 0 {
+		return nil, err
+	}
+	return mergePeers(found...), nil
+}
+
+// announceTiers asks the tiers in order and returns the peers of every tier
+// that answers. A tier is only asked once the one before it answered, failed
+// or is slow, and tiers that are still busy a while after the first answer are
+// given up on
+func (tf *TorrentFile) announceTiers(ctx context.Context, req announceRequest) ([]peers.Peer, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tiers := tf.copyTiers()
+	ps, err := askTiers(len(tiers), func(i int) <-chan tierResult {
+		res := make(chan tierResult, 1)
+		go func() {
+			resp, err := tf.announceTier(ctx, tiers[i], req)
+			if err != nil {
+				res <- tierResult{err: err}
+				return
+			}
+			res <- tierResult{peers: resp.Peers}
+		}()
+		return res
+	}, ctx.Done())
+	if errors.Is(err, errAnnouncerClosed) {
+		err = ctx.Err()
+	}
+	return ps, err
+}
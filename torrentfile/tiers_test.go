@@ -0,0 +1,175 @@
+package torrentfile
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bencode"
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// testTracker is an HTTP tracker that hands out ps and counts announces
+type testTracker struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	asked   int
+	release chan struct{} //announces block until it is closed, if set
+}
+
+func newTestTracker(t *testing.T, ps ...peers.Peer) *testTracker {
+	t.Helper()
+
+	tr := &testTracker{}
+	compact := []byte{}
+	for _, p := range ps {
+		compact = append(compact, p.IP.To4()...)
+		compact = append(compact, byte(p.Port>>8), byte(p.Port))
+	}
+	tr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr.mu.Lock()
+		tr.asked++
+		release := tr.release
+		tr.mu.Unlock()
+		if release != nil {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		body, _ := bencode.Marshal(map[string]interface{}{"interval": 1800, "peers": string(compact)})
+		w.Write(body)
+	}))
+	t.Cleanup(tr.Close)
+	return tr
+}
+
+func (tr *testTracker) announces() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return tr.asked
+}
+
+func testPeer(last byte) peers.Peer {
+	return peers.Peer{IP: net.IPv4(10, 0, 0, last), Port: 6881}
+}
+
+func peerAddrs(ps []peers.Peer) []string {
+	addrs := []string{}
+	for _, p := range ps {
+		addrs = append(addrs, p.String())
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func setFallbackDelay(t *testing.T, d time.Duration) {
+	old := TierFallbackDelay
+	TierFallbackDelay = d
+	t.Cleanup(func() { TierFallbackDelay = old })
+}
+
+func TestAnnounceTiersMergesEveryTier(t *testing.T) {
+	setFallbackDelay(t, 5*time.Second)
+	first := newTestTracker(t, testPeer(1), testPeer(2))
+	second := newTestTracker(t, testPeer(2), testPeer(3))
+
+	tf := TorrentFile{AnnounceList: [][]string{{first.URL}, {second.URL}}}
+	ps, err := tf.announceTiers(context.Background(), tf.request([20]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := peerAddrs(ps)
+	want := []string{"10.0.0.1:6881", "10.0.0.2:6881", "10.0.0.3:6881"}
+	if len(got) != len(want) {
+		t.Fatalf("got peers %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got peers %v, want %v", got, want)
+		}
+	}
+}
+
+func TestAnnounceTiersInOrder(t *testing.T) {
+	setFallbackDelay(t, 5*time.Second)
+	first := newTestTracker(t, testPeer(1))
+	second := newTestTracker(t, testPeer(2))
+	first.release = make(chan struct{})
+
+	tf := TorrentFile{AnnounceList: [][]string{{first.URL}, {second.URL}}}
+	done := make(chan []peers.Peer)
+	go func() {
+		ps, _ := tf.announceTiers(context.Background(), tf.request([20]byte{}))
+		done <- ps
+	}()
+
+	// the second tier waits for the first
+	time.Sleep(200 * time.Millisecond)
+	if second.announces() != 0 {
+		t.Fatal("the second tier was asked before the first one answered")
+	}
+	close(first.release)
+
+	ps := <-done
+	if second.announces() != 1 || len(ps) != 2 {
+		t.Errorf("got peers %v after %d announces to the second tier, want both tiers' peers", ps, second.announces())
+	}
+}
+
+func TestAnnounceTiersSlowTier(t *testing.T) {
+	setFallbackDelay(t, 100*time.Millisecond)
+	slow := newTestTracker(t, testPeer(1))
+	slow.release = make(chan struct{}) // never answers
+	fast := newTestTracker(t, testPeer(2))
+
+	tf := TorrentFile{AnnounceList: [][]string{{slow.URL}, {fast.URL}}}
+	start := time.Now()
+	ps, err := tf.announceTiers(context.Background(), tf.request([20]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("a slow tier held us up for %s", elapsed)
+	}
+	if len(ps) != 1 || ps[0].String() != "10.0.0.2:6881" {
+		t.Errorf("got peers %v, want the fast tier's", ps)
+	}
+}
+
+func TestAnnounceTiersFailedTier(t *testing.T) {
+	setFallbackDelay(t, 5*time.Second)
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer dead.Close()
+	alive := newTestTracker(t, testPeer(2))
+
+	tf := TorrentFile{AnnounceList: [][]string{{dead.URL}, {alive.URL}}}
+	start := time.Now()
+	ps, err := tf.announceTiers(context.Background(), tf.request([20]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("waited %s on a tier that failed", elapsed)
+	}
+	if len(ps) != 1 {
+		t.Errorf("got peers %v, want the second tier's", ps)
+	}
+
+	tf = TorrentFile{AnnounceList: [][]string{{dead.URL}}}
+	_, err = tf.announceTiers(context.Background(), tf.request([20]byte{}))
+	if err == nil {
+		t.Error("announce succeeded with every tracker down")
+	}
+}
@@ -0,0 +1,390 @@
+package torrentfile
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/bitfield"
+	"github.com/Richd0tcom/bookish-chainsaw/comms"
+	"github.com/Richd0tcom/bookish-chainsaw/storage"
+)
+
+// State is where a torrent of a Session is in its life
+type State int
+
+const (
+	StateChecking State = iota //finding out which pieces are already on disk
+	StateDownloading
+	StateSeeding
+	StatePaused
+	StateError //stopped by an error, Resume tries again
+)
+
+func (s State) String() string {
+	switch s {
+	case StateChecking:
+		return "checking"
+	case StateDownloading:
+		return "downloading"
+	case StateSeeding:
+		return "seeding"
+	case StatePaused:
+		return "paused"
+	case StateError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Torrent is a torrent running in a Session. Every time it is resumed it
+// checks what is on disk, downloads the rest and then seeds until paused
+type Torrent struct {
+	session *Session
+	file    *TorrentFile
+	path    string
+	added   time.Time
+
+	mu    sync.Mutex
+	state State
+	err   error //why the torrent is in StateError
+
+	//pieces we had when the torrent was last stopped. nil until it has been checked once
+	have bitfield.Bitfield
+
+	running *comms.Torrent //nil while stopped
+
+	//counters of the runs before the current one
+	downloaded int64
+	uploaded   int64
+
+	//closing halt stops the current run, which closes done when it is over
+	halt chan struct{}
+	done chan struct{}
+}
+
+// TorrentStats is a snapshot of a Torrent
+type TorrentStats struct {
+	State State
+	Err   error
+
+	Length     int64
+	Left       int64 //the whole length until the torrent has been checked
+	Downloaded int64
+	Uploaded   int64
+	Peers      int
+}
+
+// File returns the torrent's metadata
+func (t *Torrent) File() *TorrentFile {
+	return t.file
+}
+
+// Path returns where the torrent's data lives
+func (t *Torrent) Path() string {
+	return t.path
+}
+
+// State returns the torrent's state, and the error that stopped it in StateError
+func (t *Torrent) State() (State, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.state, t.err
+}
+
+// Stats returns the torrent's state and counters
+func (t *Torrent) Stats() TorrentStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := TorrentStats{
+		State:      t.state,
+		Err:        t.err,
+		Length:     int64(t.file.Length),
+		Downloaded: t.downloaded,
+		Uploaded:   t.uploaded,
+	}
+	if t.running != nil {
+		stats.Left = t.running.Left()
+		stats.Downloaded += t.running.Downloaded()
+		stats.Uploaded += t.running.Uploaded()
+		stats.Peers = t.running.NumPeers()
+	} else {
+		stats.Left = t.file.left(t.have)
+	}
+	return stats
+}
+
+// Pause stops the torrent and waits until its trackers were told
+func (t *Torrent) Pause() {
+	t.stop(true)
+}
+
+// Resume starts a paused torrent, or one that stopped with an error
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for {
+		if t.halt != nil {
+			return // running
+		}
+		// the last run may still be stopping, two runs must never share the storage.
+		// Others can start and stop runs while we wait, so check again after
+		done := t.done
+		if done == nil || isClosed(done) {
+			break
+		}
+		t.mu.Unlock()
+		<-done
+		t.mu.Lock()
+	}
+	t.state = StateChecking
+	t.err = nil
+	t.halt = make(chan struct{})
+	t.done = make(chan struct{})
+	go t.run(t.halt, t.done)
+}
+
+// stop ends the current run, if there is one. With pause the torrent is
+// paused, otherwise its state is left alone. done stays set until the next
+// run, so Resume can wait for this one to be over
+func (t *Torrent) stop(pause bool) {
+	t.mu.Lock()
+	halt, done := t.halt, t.done
+	t.halt = nil
+	if pause {
+		// in the same critical section, once halt is cleared the run can't change the state
+		t.state = StatePaused
+		t.err = nil
+	}
+	t.mu.Unlock()
+
+	if halt != nil {
+		close(halt)
+		<-done
+	}
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// setState moves the torrent on, unless the run it is called from was stopped
+func (t *Torrent) setState(halt chan struct{}, state State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.halt == halt {
+		t.state = state
+	}
+}
+
+func (t *Torrent) run(halt, done chan struct{}) {
+	defer close(done)
+
+	err := func() (err error) {
+		// a bug hit by one torrent must not take the whole session down
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Torrent %s panicked: %v\n%s", t.file.Name, r, debug.Stack())
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return t.runOnce(halt)
+	}()
+	if err == nil {
+		return
+	}
+	log.Printf("Torrent %s stopped: %v\n", t.file.Name, err)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.halt == halt {
+		t.state = StateError
+		t.err = err
+		t.halt = nil
+	}
+}
+
+// runOnce checks, downloads and seeds the torrent until halt is closed
+func (t *Torrent) runOnce(halt chan struct{}) error {
+	s := t.session
+	tf := t.file
+
+	data, err := storage.NewFile(t.path).OpenTorrent(tf.StorageInfo())
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	torrent := &comms.Torrent{
+		PeerID:        s.peerID,
+		InfoHash:      tf.InfoHash,
+		PieceHashes:   tf.PieceHashes,
+		PieceLength:   tf.PieceLength,
+		Length:        tf.Length,
+		Name:          tf.Name,
+		Storage:       data,
+		ListenPort:    s.port,
+		RawInfo:       tf.RawInfo,
+		Private:       tf.Private,
+		DownloadLimit: s.downloadLimit,
+		UploadLimit:   s.uploadLimit,
+		ConnLimit:     s.connLimit,
+	}
+
+	// closing the torrent makes Download and Serve return
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-halt:
+			torrent.Close()
+		case <-finished:
+		}
+	}()
+
+	t.mu.Lock()
+	have := t.have
+	t.mu.Unlock()
+	if have != nil {
+		torrent.MarkHave(have)
+	} else {
+		tf.resume(t.path, torrent)
+	}
+
+	t.mu.Lock()
+	t.running = torrent
+	t.mu.Unlock()
+	defer t.finishRun(torrent)
+
+	s.server.Add(torrent)
+	defer s.server.Remove(tf.InfoHash)
+
+	trackers := newAnnouncer(tf, torrent, s.peerID, s.port)
+	defer trackers.close()
+	go func() {
+		ps, err := trackers.start()
+		if err != nil && !errors.Is(err, errAnnouncerClosed) {
+			log.Printf("Trackers of %s failed: %v\n", tf.Name, err)
+		}
+		torrent.AddPeers(ps)
+	}()
+	if s.node != nil && !tf.Private {
+		go t.announceDHT(torrent, finished)
+	}
+	go tf.keepResumeSaved(t.path, torrent, finished)
+
+	if torrent.Left() > 0 {
+		t.setState(halt, StateDownloading)
+		err = torrent.Download()
+		if errors.Is(err, comms.ErrStopped) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		trackers.complete()
+		log.Printf("Finished downloading %s\n", tf.Name)
+	}
+
+	t.setState(halt, StateSeeding)
+	torrent.Serve()
+	return nil
+}
+
+// finishRun keeps what a run achieved for the next one
+func (t *Torrent) finishRun(torrent *comms.Torrent) {
+	torrent.Close()
+	bf := torrent.Bitfield()
+	err := t.file.saveResume(t.path, bf)
+	if err != nil {
+		log.Println("Could not save resume file:", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.have = bf
+	t.downloaded += torrent.Downloaded()
+	t.uploaded += torrent.Uploaded()
+	t.running = nil
+}
+
+// announceDHT looks the torrent up on the DHT every DHTAnnounceInterval until done is closed
+func (t *Torrent) announceDHT(torrent *comms.Torrent, done <-chan struct{}) {
+	for {
+		ps, err := t.session.node.Announce(t.file.InfoHash, t.session.port)
+		if err != nil {
+			log.Printf("DHT lookup for %s failed: %v\n", t.file.Name, err)
+		}
+		torrent.AddPeers(ps)
+
+		select {
+		case <-done:
+			return
+		case <-time.After(DHTAnnounceInterval):
+		}
+	}
+}
+
+// deleteData removes the torrent's files, the directories they were in if
+// they are empty now, and the resume file
+func (t *Torrent) deleteData() error {
+	var firstErr error
+	remove := func(path string) {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	dirs := map[string]bool{}
+	for _, f := range t.file.Files {
+		local := f.LocalPath(t.path)
+		remove(local)
+		for dir := filepath.Dir(local); len(f.Path) > 0 && dir != filepath.Dir(t.path); dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	// deepest first, so parents are empty by the time we get to them
+	sorted := []string{}
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	for _, dir := range sorted {
+		os.Remove(dir) // fails if something else is in there, which we leave alone
+	}
+
+	remove(resumePath(t.path))
+	return firstErr
+}
+
+// left returns the bytes missing from bf. A nil bitfield means nothing was checked yet
+func (tf *TorrentFile) left(bf bitfield.Bitfield) int64 {
+	left := int64(0)
+	for i := range tf.PieceHashes {
+		if !bf.HasPiece(i) {
+			left += int64(min(tf.PieceLength, tf.Length-i*tf.PieceLength))
+		}
+	}
+	return left
+}
@@ -0,0 +1,292 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Richd0tcom/bookish-chainsaw/peers"
+)
+
+// UDP tracker protocol (BEP 15)
+
+const udpProtocolID uint64 = 0x41727101980
+
+const (
+	udpActionConnect uint32 = iota
+	udpActionAnnounce
+	udpActionScrape
+	udpActionError
+)
+
+// UDPTimeoutBase is the first retransmit timeout. Attempt n waits UDPTimeoutBase * 2^n
+var UDPTimeoutBase = 15 * time.Second
+
+// UDPMaxRetries is the number of retransmits before we give up on a UDP tracker
+var UDPMaxRetries = 8
+
+// UDPTimeout caps how long one request to a UDP tracker takes, retransmits
+// included. The schedule of the spec alone would keep going for about two hours
+var UDPTimeout = time.Minute
+
+// a connection ID may be reused for one minute after we receive it
+const udpConnIDLifetime = time.Minute
+
+type udpConnID struct {
+	id       uint64
+	received time.Time
+}
+
+var (
+	udpConnIDsMu sync.Mutex
+	udpConnIDs   = make(map[string]udpConnID)
+)
+
+// ScrapeResult holds swarm statistics for a single torrent
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+type udpTracker struct {
+	host string
+	conn net.Conn
+	ctx  context.Context
+
+	//stops closing conn once ctx is done
+	stopWatching func() bool
+}
+
+// dialUDPTracker connects to a tracker. Cancelling ctx makes requests in flight fail
+func dialUDPTracker(ctx context.Context, host string) (*udpTracker, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", host)
+	if err != nil {
+		return nil, err
+	}
+	t := &udpTracker{host: host, conn: conn, ctx: ctx}
+	t.stopWatching = context.AfterFunc(ctx, func() { conn.Close() })
+	return t, nil
+}
+
+func (t *udpTracker) Close() error {
+	t.stopWatching()
+	return t.conn.Close()
+}
+
+func newTransactionID() (uint32, error) {
+	buf := make([]byte, 4)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+// connectionID returns a cached connection ID for the tracker or asks for a new one
+func (t *udpTracker) connectionID() (uint64, error) {
+	udpConnIDsMu.Lock()
+	cached, ok := udpConnIDs[t.host]
+	udpConnIDsMu.Unlock()
+	if ok && time.Since(cached.received) < udpConnIDLifetime {
+		return cached.id, nil
+	}
+
+	// connect: <protocol_id><action><transaction_id>
+	resp, err := t.roundTrip(udpActionConnect, false, func(_ uint64, txID uint32) []byte {
+		req := make([]byte, 16)
+		binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		return req
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 8 {
+		return 0, fmt.Errorf("udp tracker sent connect response of length %d", len(resp))
+	}
+
+	id := binary.BigEndian.Uint64(resp[0:8])
+	udpConnIDsMu.Lock()
+	udpConnIDs[t.host] = udpConnID{id: id, received: time.Now()}
+	udpConnIDsMu.Unlock()
+	return id, nil
+}
+
+// roundTrip sends the request built by build and waits for the response with the
+// same transaction ID, retransmitting on the schedule from the spec. It returns the
+// response body after the action and transaction ID. If needsConnID is set the
+// connection ID is looked up again before every attempt, because it may expire
+// while we are retrying
+func (t *udpTracker) roundTrip(action uint32, needsConnID bool, build func(connID uint64, txID uint32) []byte) ([]byte, error) {
+	txID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65536)
+	giveUp := time.Now().Add(UDPTimeout)
+	for n := 0; n <= UDPMaxRetries && time.Now().Before(giveUp); n++ {
+		var connID uint64
+		if needsConnID {
+			connID, err = t.connectionID()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, err = t.conn.Write(build(connID, txID))
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return nil, t.ctx.Err()
+			}
+			return nil, err
+		}
+
+		deadline := time.Now().Add(UDPTimeoutBase << n)
+		if deadline.After(giveUp) {
+			deadline = giveUp
+		}
+		t.conn.SetReadDeadline(deadline)
+		for {
+			length, err := t.conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break // retransmit
+				}
+				if t.ctx.Err() != nil {
+					return nil, t.ctx.Err() // closed by the context
+				}
+				return nil, err
+			}
+			if length < 8 || binary.BigEndian.Uint32(buf[4:8]) != txID {
+				continue // not ours
+			}
+
+			respAction := binary.BigEndian.Uint32(buf[0:4])
+			if respAction == udpActionError {
+				return nil, &TrackerError{Tracker: "udp://" + t.host, Reason: string(buf[8:length])}
+			}
+			if respAction != action {
+				return nil, fmt.Errorf("expected udp tracker action %d but got %d", action, respAction)
+			}
+
+			body := make([]byte, length-8)
+			copy(body, buf[8:length])
+			return body, nil
+		}
+	}
+	return nil, fmt.Errorf("udp tracker %s did not answer within %s", t.host, UDPTimeout)
+}
+
+// event codes of udp announces
+var udpEvents = map[string]uint32{
+	eventNone:      0,
+	eventCompleted: 1,
+	eventStarted:   2,
+	eventStopped:   3,
+}
+
+// announceUDP announces to a udp:// tracker and returns the peers it knows of
+func (tf *TorrentFile) announceUDP(ctx context.Context, host string, req announceRequest) (*announceResponse, error) {
+	t, err := dialUDPTracker(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+
+	key, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.roundTrip(udpActionAnnounce, true, func(connID uint64, txID uint32) []byte {
+		// <connection_id><action><transaction_id><info_hash><peer_id><downloaded><left>
+		// <uploaded><event><IP address><key><num_want><port>
+		msg := make([]byte, 98)
+		binary.BigEndian.PutUint64(msg[0:8], connID)
+		binary.BigEndian.PutUint32(msg[8:12], udpActionAnnounce)
+		binary.BigEndian.PutUint32(msg[12:16], txID)
+		copy(msg[16:36], tf.InfoHash[:])
+		copy(msg[36:56], req.PeerID[:])
+		binary.BigEndian.PutUint64(msg[56:64], uint64(req.Downloaded))
+		binary.BigEndian.PutUint64(msg[64:72], uint64(req.Left))
+		binary.BigEndian.PutUint64(msg[72:80], uint64(req.Uploaded))
+		binary.BigEndian.PutUint32(msg[80:84], udpEvents[req.Event])
+		binary.BigEndian.PutUint32(msg[84:88], 0) // let the tracker use the source address
+		binary.BigEndian.PutUint32(msg[88:92], key)
+		binary.BigEndian.PutUint32(msg[92:96], 0xFFFFFFFF) // num_want -1 means default
+		binary.BigEndian.PutUint16(msg[96:98], req.Port)
+		return msg
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// <interval><leechers><seeders> followed by compact peers. Trackers we reach
+	// over IPv6 send 18 byte IPv6 peers instead
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("udp tracker sent announce response of length %d", len(resp))
+	}
+	parse := peers.ParsePeers
+	if addr, ok := t.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		parse = peers.ParsePeers6
+	}
+	ps, err := parse(resp[12:])
+	if err != nil {
+		return nil, err
+	}
+	return &announceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(resp[0:4])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(resp[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[8:12])),
+		Peers:    ps,
+	}, nil
+}
+
+// scrapeUDP asks a udp:// tracker for swarm statistics of each infohash
+func scrapeUDP(host string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	t, err := dialUDPTracker(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+
+	resp, err := t.roundTrip(udpActionScrape, true, func(connID uint64, txID uint32) []byte {
+		// <connection_id><action><transaction_id> followed by infohashes
+		req := make([]byte, 16, 16+20*len(infoHashes))
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		for _, ih := range infoHashes {
+			req = append(req, ih[:]...)
+		}
+		return req
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// <seeders><completed><leechers> for each infohash, in request order
+	if len(resp) < 12*len(infoHashes) {
+		return nil, fmt.Errorf("udp tracker sent scrape response of length %d for %d torrents", len(resp), len(infoHashes))
+	}
+	results := make([]ScrapeResult, len(infoHashes))
+	for i := range results {
+		offset := i * 12
+		results[i] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(resp[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(resp[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(resp[offset+8 : offset+12])),
+		}
+	}
+	return results, nil
+}
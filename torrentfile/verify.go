@@ -0,0 +1,25 @@
+package torrentfile
+
+import (
+	"github.com/Richd0tcom/bookish-chainsaw/comms"
+	"github.com/Richd0tcom/bookish-chainsaw/storage"
+)
+
+// Verify hashes the data at path against the torrent's piece hashes without
+// changing anything. Like DownloadToFile, single-file torrents are read from
+// path itself and multi-file torrents from below it
+func (t *TorrentFile) Verify(path string) ([]comms.PieceStatus, error) {
+	err := t.checkPieces()
+	if err != nil {
+		return nil, err
+	}
+
+	st := storage.File{Path: path, ReadOnly: true}
+	data, err := st.OpenTorrent(t.StorageInfo())
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	return comms.VerifyPieces(data, t.PieceHashes, t.PieceLength, t.Length), nil
+}
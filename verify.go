@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Richd0tcom/bookish-chainsaw/comms"
+	"github.com/Richd0tcom/bookish-chainsaw/torrentfile"
+)
+
+// exit codes of verify
+const (
+	verifyOK         = 0
+	verifyDamaged    = 1 //some pieces are bad or missing
+	verifyUsage      = 2
+	verifyBadTorrent = 3 //the torrent itself could not be read
+)
+
+// runVerify checks data on disk against a torrent's piece hashes
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	quiet := fs.Bool("q", false, "print nothing, only set the exit status")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s verify [-q] <file.torrent> <path>\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "exits with %d if every piece is good, %d if pieces are bad or missing, %d if the torrent can't be read\n", verifyOK, verifyDamaged, verifyBadTorrent)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(verifyUsage)
+	}
+
+	tf, err := torrentfile.OpenFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		os.Exit(verifyBadTorrent)
+	}
+	status, err := tf.Verify(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(1), err)
+		os.Exit(verifyBadTorrent)
+	}
+
+	byStatus := map[comms.PieceStatus][]int{}
+	for index, s := range status {
+		byStatus[s] = append(byStatus[s], index)
+	}
+	bad, missing := byStatus[comms.PieceBad], byStatus[comms.PieceMissing]
+
+	if !*quiet {
+		fmt.Printf("%d pieces: %d good, %d bad, %d missing\n", len(status), len(byStatus[comms.PieceGood]), len(bad), len(missing))
+		if len(bad) > 0 {
+			fmt.Printf("bad pieces: %s\n", formatRanges(bad))
+		}
+		if len(missing) > 0 {
+			fmt.Printf("missing pieces: %s\n", formatRanges(missing))
+		}
+		printDamagedFiles(tf, status)
+	}
+
+	if len(bad) > 0 || len(missing) > 0 {
+		os.Exit(verifyDamaged)
+	}
+}
+
+// printDamagedFiles lists every file a bad or missing piece overlaps
+func printDamagedFiles(tf torrentfile.TorrentFile, status []comms.PieceStatus) {
+	counts := make([]map[comms.PieceStatus]int, len(tf.Files))
+	for index, s := range status {
+		if s == comms.PieceGood {
+			continue
+		}
+		for _, span := range tf.Files.PieceSpans(index, tf.PieceLength) {
+			if counts[span.File] == nil {
+				counts[span.File] = map[comms.PieceStatus]int{}
+			}
+			counts[span.File][s]++
+		}
+	}
+
+	for i, c := range counts {
+		if c == nil {
+			continue
+		}
+		path := tf.Name
+		if len(tf.Files[i].Path) > 0 {
+			path += "/" + strings.Join(tf.Files[i].Path, "/")
+		}
+		fmt.Printf("damaged: %s (%d bad, %d missing pieces)\n", path, c[comms.PieceBad], c[comms.PieceMissing])
+	}
+}
+
+// formatRanges prints sorted indexes with runs collapsed, e.g. 1, 4-7, 9
+func formatRanges(indexes []int) string {
+	parts := []string{}
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && indexes[j+1] == indexes[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(indexes[i]))
+		} else {
+			parts = append(parts, strconv.Itoa(indexes[i])+"-"+strconv.Itoa(indexes[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}